@@ -0,0 +1,431 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"image"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/whomever000/poker-client-pokerstars/handhistory"
+	"github.com/whomever000/poker-client-pokerstars/history"
+	"github.com/whomever000/poker-client-pokerstars/vision"
+	"github.com/whomever000/poker-common"
+	"github.com/whomever000/poker-common/card"
+)
+
+// This file contains the accuracy command. It replays an image-dump through
+// the vision functions and compares the readings with the hand history the
+// PokerStars client wrote for the same session.
+
+// accuracy runs the accuracy command.
+func accuracy(args []string) error {
+	fs := flag.NewFlagSet("accuracy", flag.ExitOnError)
+	pid := fs.Int("h", 0, "pid of history")
+	fs.Parse(args)
+
+	if *pid == 0 || fs.NArg() != 1 {
+		return fmt.Errorf("usage: accuracy -h <pid> <hand-history file>")
+	}
+
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	hands, err := handhistory.Parse(f)
+	f.Close()
+	if err != nil {
+		return err
+	}
+
+	frames, err := history.List(*pid)
+	if err != nil {
+		return err
+	}
+
+	r := newReport()
+	r.replay(hands, frames)
+	r.print(os.Stdout)
+	return nil
+}
+
+// check is a single comparison of a vision reading with the hand history.
+type check struct {
+	frame    string
+	region   string
+	expected string
+	actual   string
+}
+
+// report collects the checks of a replay.
+type report struct {
+	checks []check
+	view   *vision.Table
+
+	// State of the hand being replayed.
+	hand   *handhistory.Hand
+	offset int
+	round  int
+	action int
+	stacks map[poker.PlayerPosition]poker.Amount
+	// bets are what the seats put in in the current round.
+	bets map[poker.PlayerPosition]poker.Amount
+}
+
+func newReport() *report {
+	return &report{view: vision.NewTable()}
+}
+
+// add records a check.
+func (r *report) add(frame, region string, expected, actual interface{}) {
+	r.checks = append(r.checks, check{
+		frame:    frame,
+		region:   region,
+		expected: fmt.Sprint(expected),
+		actual:   fmt.Sprint(actual),
+	})
+}
+
+// replay reads every frame and compares it with the hand it belongs to. The
+// dump may hold frames of other tables than the one of the hand history,
+// which are skipped.
+func (r *report) replay(hands []*handhistory.Hand, frames []history.Frame) {
+	// The frames are decoded in order, so each delta builds on the image
+	// decoded before it.
+	var dec history.Decoder
+	for _, f := range frames {
+		hand := handAt(hands, f.Time)
+		if hand == nil || !sameTable(f, hand) {
+			continue
+		}
+
+		// Duplicates have no file of their own.
+		name := f.Path
+		if name == "" {
+			name = fmt.Sprintf("frame %v", f.Seq)
+		}
+
+		img, err := dec.Image(f)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to read %v. %v\n", name, err)
+			continue
+		}
+
+		switch f.Descr {
+		case "waitForCardsDealt":
+			r.newHand(hand, img)
+			r.checkHeader(name, img)
+		case "waitForCommCards":
+			if r.hand == hand {
+				r.checkRound(name, img)
+			}
+		case "waitForAction":
+			if r.hand == hand {
+				r.checkAction(name, img)
+			}
+		}
+	}
+}
+
+// handAt returns the last hand started before the given time.
+func handAt(hands []*handhistory.Hand, t time.Time) *handhistory.Hand {
+	var ret *handhistory.Hand
+	for _, h := range hands {
+		if !time.Time(h.Date).After(t) {
+			ret = h
+		}
+	}
+	return ret
+}
+
+// sameTable returns whether a frame is of the table of a hand. Frames of
+// dumps without a manifest have no table and are taken to be of it.
+func sameTable(f history.Frame, hand *handhistory.Hand) bool {
+	if f.Table == "" {
+		return true
+	}
+	// The window name starts with the name of the table, e.g.
+	// "Aaltje II - $0.01/$0.02 USD - No Limit Hold'em 6-max".
+	name := strings.Split(history.TableName(f.Table), " - ")[0]
+	return name == hand.Table.Name
+}
+
+// seat returns the hand-history seat of a position on the screen. The client
+// may rotate the seats (preferred seat), so the two do not have to match.
+func (r *report) seat(pos poker.PlayerPosition) poker.PlayerPosition {
+	size := r.hand.Table.Size
+	return poker.PlayerPosition((int(pos)-1+r.offset)%size + 1)
+}
+
+// position returns the screen position of a hand-history seat.
+func (r *report) position(seat poker.PlayerPosition) poker.PlayerPosition {
+	size := r.hand.Table.Size
+	return poker.PlayerPosition((int(seat)-1-r.offset+size)%size + 1)
+}
+
+// player returns the hand-history player at a position on the screen.
+func (r *report) player(pos poker.PlayerPosition) poker.Player {
+	seat := r.seat(pos)
+	if int(seat) > len(r.hand.Players) {
+		return poker.Player{}
+	}
+	return r.hand.Players[seat-1]
+}
+
+// newHand starts replaying a hand. The seat rotation is the one for which
+// most names read from the image match the hand history.
+func (r *report) newHand(hand *handhistory.Hand, img image.Image) {
+	if err := r.view.SetLayout(hand.Table.Size); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+	}
+
+	r.hand = hand
+	r.round = -1
+	r.action = 0
+	r.stacks = make(map[poker.PlayerPosition]poker.Amount)
+	r.bets = make(map[poker.PlayerPosition]poker.Amount)
+
+	names := make([]string, hand.Table.Size)
+	for i := range names {
+		names[i], _, _ = r.view.PlayerName(img, poker.PlayerPosition(i+1))
+	}
+
+	best, bestOffset := -1, 0
+	for offset := 0; offset < hand.Table.Size; offset++ {
+		r.offset = offset
+		matches := 0
+		for i, name := range names {
+			if name != "" && r.player(poker.PlayerPosition(i+1)).Name == name {
+				matches++
+			}
+		}
+		if matches > best {
+			best, bestOffset = matches, offset
+		}
+	}
+	r.offset = bestOffset
+
+	for i, p := range hand.Players {
+		r.stacks[poker.PlayerPosition(i+1)] = p.Stack
+	}
+	// The forced bets, including dead blinds and antes, are off the stacks
+	// by the time the cards are dealt. Only their live part is shown as a
+	// bet.
+	if posted := hand.Posts(); len(posted) != 0 {
+		for _, a := range posted {
+			post := a.Action.(handhistory.PostAction)
+			r.put(a.Position, post.Amount)
+			r.bets[a.Position] += post.Live(hand.Table.Stakes)
+		}
+	} else {
+		r.bet(hand.SmallBlind, hand.Table.Stakes.SmallBlind)
+		r.bet(hand.BigBlind, hand.Table.Stakes.BigBlind)
+	}
+}
+
+// put moves chips of the player in the given seat into the pot.
+func (r *report) put(seat poker.PlayerPosition, amount poker.Amount) {
+	if seat == 0 {
+		return
+	}
+	r.stacks[seat] -= amount
+}
+
+// bet moves chips of the player in the given seat in front of the seat.
+func (r *report) bet(seat poker.PlayerPosition, amount poker.Amount) {
+	if seat == 0 {
+		return
+	}
+	r.put(seat, amount)
+	r.bets[seat] += amount
+}
+
+// stack returns the stack of a seat as vision reports it.
+func (r *report) stack(seat poker.PlayerPosition) poker.Amount {
+	if r.stacks[seat] == 0 {
+		return poker.Amount(-1)
+	}
+	return r.stacks[seat]
+}
+
+// checkHeader compares names, stacks, button and hole cards at the start of
+// a hand.
+func (r *report) checkHeader(frame string, img image.Image) {
+	for pos := poker.PlayerPosition(1); int(pos) <= r.hand.Table.Size; pos++ {
+		p := r.player(pos)
+
+		name, _, _ := r.view.PlayerName(img, pos)
+		r.add(frame, fmt.Sprintf("plName%v", pos-1), p.Name, name)
+
+		if p.Name == "" {
+			continue
+		}
+		stack, _, err := r.view.PlayerStack(img, pos)
+		if err != nil {
+			r.add(frame, fmt.Sprintf("plStack%v", pos-1), r.stack(r.seat(pos)), err)
+			continue
+		}
+		r.add(frame, fmt.Sprintf("plStack%v", pos-1), r.stack(r.seat(pos)), stack)
+	}
+
+	button := r.position(r.hand.Button)
+	if pos, err := r.view.ButtonPosition(img); err != nil {
+		r.add(frame, fmt.Sprintf("button%v", button-1), button, err)
+	} else {
+		r.add(frame, fmt.Sprintf("button%v", button-1), button, pos)
+	}
+
+	// Our hole cards are read at our seat, like the cards shown at showdown.
+	if r.hand.ThisPlayer != nil {
+		hero := r.position(r.hand.ThisPlayer.Position)
+		pos, cards, _, err := r.view.HoleCards(img)
+		if err != nil || pos != hero {
+			cards = nil
+		}
+		r.addCards(frame, r.view.HoleCardsRegion(hero),
+			r.hand.ThisPlayer.Cards, cards)
+	}
+}
+
+// checkRound compares the board and the pot at the start of the next round.
+func (r *report) checkRound(frame string, img image.Image) {
+	r.round++
+	r.action = 0
+	// The bets of the previous round are in the pot.
+	if r.round > 0 {
+		r.bets = make(map[poker.PlayerPosition]poker.Amount)
+	}
+	if r.round >= len(r.hand.Rounds) {
+		return
+	}
+	round := r.hand.Rounds[r.round]
+
+	// A hand which was run twice shows its second board below the first.
+	boards, _, _ := r.view.CommunityBoards(img)
+	for len(boards) < 2 {
+		boards = append(boards, nil)
+	}
+	if len(r.hand.Boards) == 2 {
+		n := len(round.Cards)
+		r.addCards(frame, "commTop", round.Cards, boards[0])
+		r.addCards(frame, "commBot", r.hand.Boards[1][:n], boards[1])
+	} else {
+		r.addCards(frame, "comm", round.Cards, boards[0])
+	}
+
+	pot, _, err := r.view.Pot(img)
+	if err != nil {
+		r.add(frame, "pot", round.Pot, err)
+		return
+	}
+	r.add(frame, "pot", round.Pot, pot)
+}
+
+// checkAction compares the next action of the current round, and the bet and
+// stack of the player after it.
+func (r *report) checkAction(frame string, img image.Image) {
+	if r.round < 0 || r.round >= len(r.hand.Rounds) {
+		return
+	}
+	actions := r.hand.Rounds[r.round].Actions
+	// The forced bets were put in at the start of the hand.
+	for r.action < len(actions) {
+		if _, ok := actions[r.action].Action.(handhistory.PostAction); !ok {
+			break
+		}
+		r.action++
+	}
+	if r.action >= len(actions) {
+		return
+	}
+	a := actions[r.action]
+	r.action++
+
+	name, amount := actionName(a.Action)
+	r.bet(a.Position, amount)
+
+	pos := r.position(a.Position)
+	action, _, _ := r.view.PlayerAction(img, pos)
+	r.add(frame, fmt.Sprintf("plAction%v", pos-1), name, action)
+
+	bet, _, err := r.view.PlayerBet(img, pos)
+	if err != nil {
+		r.add(frame, fmt.Sprintf("plBet%v", pos-1), r.bets[a.Position], err)
+	} else {
+		r.add(frame, fmt.Sprintf("plBet%v", pos-1), r.bets[a.Position], bet)
+	}
+
+	stack, _, err := r.view.PlayerStack(img, pos)
+	if err != nil {
+		r.add(frame, fmt.Sprintf("plStack%v", pos-1), r.stack(a.Position), err)
+		return
+	}
+	r.add(frame, fmt.Sprintf("plStack%v", pos-1), r.stack(a.Position), stack)
+}
+
+// addCards records the checks of the values and colors of cards.
+func (r *report) addCards(frame, prefix string, expected, actual []card.Card) {
+	for i, c := range expected {
+		exp := c.String()
+		act := "  "
+		if i < len(actual) {
+			act = actual[i].String()
+		}
+		r.add(frame, fmt.Sprintf("%vValue%v", prefix, i), exp[:1], act[:1])
+		r.add(frame, fmt.Sprintf("%vColor%v", prefix, i), exp[1:], act[1:])
+	}
+}
+
+// actionName returns the name of the reference image of an action and the
+// amount put in with it.
+func actionName(a poker.Action) (string, poker.Amount) {
+	switch act := a.(type) {
+	case poker.FoldAction:
+		return "actionFold", 0
+	case poker.CheckAction:
+		return "actionCheck", 0
+	case poker.CallAction:
+		return "actionCall", act.Amount
+	case poker.BetAction:
+		return "actionBet", act.Amount
+	case poker.RaiseAction:
+		return "actionRaise", act.Amount
+	}
+	return "", 0
+}
+
+// print writes the accuracy per region followed by all disagreements.
+func (r *report) print(w io.Writer) {
+	total := make(map[string]int)
+	correct := make(map[string]int)
+	var regions []string
+
+	for _, c := range r.checks {
+		if _, ok := total[c.region]; !ok {
+			regions = append(regions, c.region)
+		}
+		total[c.region]++
+		if c.expected == c.actual {
+			correct[c.region]++
+		}
+	}
+	sort.Strings(regions)
+
+	fmt.Fprintln(w, "Accuracy per region:")
+	for _, region := range regions {
+		fmt.Fprintf(w, "  %-16v %6.1f%% (%v/%v)\n", region,
+			100*float64(correct[region])/float64(total[region]),
+			correct[region], total[region])
+	}
+
+	fmt.Fprintln(w, "\nDisagreements:")
+	for _, c := range r.checks {
+		if c.expected != c.actual {
+			fmt.Fprintf(w, "  %v: %v expected %q, got %q\n", c.frame, c.region,
+				c.expected, c.actual)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"image"
+	"image/png"
+	"math"
+	"os"
+
+	"github.com/whomever000/poker-client-pokerstars/vision"
+)
+
+// This file contains the calibrate command. It finds the table in a screenshot
+// and writes the reference file with the regions where they are on this
+// machine.
+
+// calibrate runs the calibrate command.
+func calibrate(args []string) error {
+	fs := flag.NewFlagSet("calibrate", flag.ExitOnError)
+	name := fs.String("w", "Play Money", "name of the table window to calibrate")
+	seats := fs.Int("s", 0, "number of seats (default: detect)")
+	out := fs.String("o", "./calibrated.json", "corrected layout file")
+	fs.Parse(args)
+
+	if fs.NArg() > 1 {
+		return fmt.Errorf("usage: calibrate [-w <window>] [-s <seats>] " +
+			"[-o <file>] [screenshot]")
+	}
+
+	// Take the screenshot from the file, or else from the table window.
+	var shot image.Image
+	if fs.NArg() == 1 {
+		f, err := os.Open(fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		shot, err = png.Decode(f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+	} else {
+		s, err := Attach(*name, nil, nil)
+		if err != nil {
+			return err
+		}
+		s.getImage("calibrate")
+		shot = s.img()
+	}
+
+	if *seats == 0 {
+		var err error
+		if *seats, err = vision.DetectSeats(shot); err != nil {
+			return err
+		}
+	}
+	view := vision.NewTable()
+	if err := view.SetLayout(*seats); err != nil {
+		return err
+	}
+
+	t, err := view.DetectFrame(shot)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("layout: %v-max\n", *seats)
+	fmt.Printf("frame:  %v\n", t)
+	if math.Abs(t.Scale-1) > 0.01 {
+		fmt.Println("warning: the table is scaled, but the reference images " +
+			"in the layout are not.")
+	}
+
+	f, err := os.Create(*out)
+	if err != nil {
+		return err
+	}
+	if err := view.WriteLayout(f, t, shot.Bounds().Size()); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	fmt.Printf("wrote %v\n", *out)
+	return nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"image/png"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/whomever000/poker-client-pokerstars/history"
+)
+
+// This file contains the extract command. It writes frames of an image-dump
+// back to whole PNG files, however they were recorded.
+
+// extract runs the extract command.
+func extract(args []string) error {
+	fs := flag.NewFlagSet("extract", flag.ExitOnError)
+	pid := fs.Int("h", 0, "pid of history")
+	out := fs.String("o", "./extracted/", "output directory")
+	fs.Parse(args)
+
+	if *pid == 0 {
+		return fmt.Errorf("usage: extract -h <pid> [-o <dir>] [seq ...]")
+	}
+
+	// Extract the given frames, or else all of them.
+	want := make(map[int]bool)
+	for _, arg := range fs.Args() {
+		seq, err := strconv.Atoi(arg)
+		if err != nil {
+			return fmt.Errorf("invalid sequence number %q", arg)
+		}
+		want[seq] = true
+	}
+
+	frames, err := history.List(*pid)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(*out, os.ModePerm); err != nil {
+		return err
+	}
+
+	var dec history.Decoder
+	for _, f := range frames {
+		if fs.NArg() > 0 && !want[f.Seq] {
+			continue
+		}
+		delete(want, f.Seq)
+
+		img, err := dec.Image(f)
+		if err != nil {
+			return err
+		}
+
+		path := filepath.Join(*out, fmt.Sprintf("%06d_%v.png", f.Seq, f.Descr))
+		file, err := os.Create(path)
+		if err != nil {
+			return err
+		}
+		err = png.Encode(file, img)
+		file.Close()
+		if err != nil {
+			return err
+		}
+		fmt.Println(path)
+	}
+
+	for seq := range want {
+		return fmt.Errorf("no frame %v in the dump of %v", seq, *pid)
+	}
+	return nil
+}
@@ -0,0 +1,542 @@
+package handhistory
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/whomever000/poker-common"
+	"github.com/whomever000/poker-common/card"
+)
+
+// Write writes a hand in PokerStars hand-history format.
+//
+// The stacks of h.Players are the stacks at the start of the hand, before the
+// blinds were posted. The amount of a call, bet or raise is the amount the
+// player put in with that action. When nobody collected anything and only one
+// player is left, that player is taken to have won the pot.
+func Write(w io.Writer, h *Hand) error {
+	e := newExport(h)
+	e.header()
+	e.rounds()
+	e.result()
+	e.summary()
+
+	_, err := w.Write(e.buf.Bytes())
+	return err
+}
+
+// export holds the state needed while writing a single hand.
+type export struct {
+	h   *Hand
+	buf bytes.Buffer
+
+	// Chips put in by each player in the current round and in total.
+	street map[poker.PlayerPosition]poker.Amount
+	total  map[poker.PlayerPosition]poker.Amount
+	// Chips left in front of each player.
+	stack map[poker.PlayerPosition]poker.Amount
+	// Highest amount put in by a player in the current round.
+	highest poker.Amount
+
+	// Round in which each player folded.
+	folded map[poker.PlayerPosition]int
+	// Amounts won from the pots.
+	collected []Payout
+}
+
+func newExport(h *Hand) *export {
+	e := &export{
+		h:      h,
+		street: make(map[poker.PlayerPosition]poker.Amount),
+		total:  make(map[poker.PlayerPosition]poker.Amount),
+		stack:  make(map[poker.PlayerPosition]poker.Amount),
+		folded: make(map[poker.PlayerPosition]int),
+	}
+	for i, p := range h.Players {
+		e.stack[poker.PlayerPosition(i+1)] = p.Stack
+	}
+	return e
+}
+
+func (e *export) printf(format string, a ...interface{}) {
+	fmt.Fprintf(&e.buf, format, a...)
+	e.buf.WriteString("\n")
+}
+
+// name returns the name of the player at the given position.
+func (e *export) name(pos poker.PlayerPosition) string {
+	if pos < 1 || int(pos) > len(e.h.Players) {
+		return fmt.Sprintf("Seat %v", int(pos))
+	}
+	return e.h.Players[pos-1].Name
+}
+
+// put moves chips from a player's stack into the pot.
+func (e *export) put(pos poker.PlayerPosition, amount poker.Amount) {
+	e.stack[pos] -= amount
+	e.street[pos] += amount
+	e.total[pos] += amount
+	if e.street[pos] > e.highest {
+		e.highest = e.street[pos]
+	}
+}
+
+// header writes the hand header, the seats, the blinds and the hole cards.
+func (e *export) header() {
+	h := e.h
+	stakes := h.Table.Stakes
+
+	e.printf("PokerStars Hand #%v:  %v (%v/%v) - %v ET", h.HandID,
+		headerGame(h.Table.Game), formatAmount(stakes.SmallBlind),
+		formatAmount(stakes.BigBlind),
+		time.Time(h.Date).In(easternTime()).Format(dateLayout))
+	e.printf("Table '%v' %v-max Seat #%v is the button", h.Table.Name,
+		h.Table.Size, int(h.Button))
+
+	for i, p := range h.Players {
+		if p.Name == "" {
+			continue
+		}
+		out := ""
+		if h.sittingOut(poker.PlayerPosition(i + 1)) {
+			out = " is sitting out"
+		}
+		e.printf("Seat %v: %v (%v in chips)%v", i+1, p.Name,
+			formatAmount(p.Stack), out)
+	}
+
+	if posted := h.Posts(); len(posted) != 0 {
+		for _, a := range posted {
+			post := a.Action.(PostAction)
+			live := post.Live(stakes)
+			e.put(a.Position, live)
+			e.stack[a.Position] -= post.Amount - live
+			e.total[a.Position] += post.Amount - live
+			e.printf("%v: %v", e.name(a.Position), post)
+		}
+	} else {
+		if h.SmallBlind != 0 {
+			e.put(h.SmallBlind, stakes.SmallBlind)
+			e.printf("%v: posts small blind %v", e.name(h.SmallBlind),
+				formatAmount(stakes.SmallBlind))
+		}
+		if h.BigBlind != 0 {
+			e.put(h.BigBlind, stakes.BigBlind)
+			e.printf("%v: posts big blind %v", e.name(h.BigBlind),
+				formatAmount(stakes.BigBlind))
+		}
+	}
+
+	e.printf("*** HOLE CARDS ***")
+	if h.ThisPlayer != nil && len(h.ThisPlayer.Cards) != 0 {
+		e.printf("Dealt to %v %v", e.name(h.ThisPlayer.Position),
+			formatCards(h.ThisPlayer.Cards))
+	}
+}
+
+// twice returns whether the hand was run twice.
+func (e *export) twice() bool {
+	return len(e.h.Boards) == 2
+}
+
+// shared returns the number of cards both boards of a hand which was run
+// twice have in common, i.e. the cards dealt before the players were all-in.
+func (e *export) shared() int {
+	first, second := e.h.Boards[0], e.h.Boards[1]
+	n := 0
+	for n < len(first) && n < len(second) && first[n] == second[n] {
+		n++
+	}
+	return n
+}
+
+// rounds writes the betting rounds.
+func (e *export) rounds() {
+
+	// Bets can only be left uncalled in the last round with any action.
+	last := 0
+	for i, r := range e.h.Rounds {
+		if len(r.Actions) != 0 {
+			last = i
+		}
+	}
+
+	// Streets dealt after the players were all-in are named after the board
+	// when the hand was run twice.
+	shared := 5
+	if e.twice() {
+		shared = e.shared()
+	}
+
+	for i, r := range e.h.Rounds {
+
+		if i > 0 {
+			e.street = make(map[poker.PlayerPosition]poker.Amount)
+			e.highest = 0
+
+			board := ""
+			if len(r.Cards) > shared {
+				board = boardNames[0] + " "
+			}
+			e.streetHeader(i, board, r.Cards)
+		}
+
+		for _, a := range r.Actions {
+			e.action(i, a)
+		}
+
+		if i == last {
+			e.returnUncalled()
+		}
+	}
+
+	if len(e.h.Rounds) == 0 {
+		e.returnUncalled()
+	}
+
+	if e.twice() {
+		second := e.h.Boards[1]
+		for i := 1; i < len(streetNames); i++ {
+			if n := i + 2; n > shared && n <= len(second) {
+				e.streetHeader(i, boardNames[1]+" ", second[:n])
+			}
+		}
+	}
+}
+
+// streetHeader writes the line starting a street, e.g. "*** FLOP ***". The
+// board is the prefix of the name of the street.
+func (e *export) streetHeader(street int, board string, cards []card.Card) {
+	switch street {
+	case 1:
+		e.printf("*** %vFLOP *** %v", board, formatCards(cards))
+	case 2, 3:
+		if len(cards) == 0 {
+			break
+		}
+		n := len(cards) - 1
+		e.printf("*** %v%v *** %v [%v]", board,
+			strings.ToUpper(streetNames[street]), formatCards(cards[:n]),
+			cards[n])
+	}
+}
+
+// action writes a single player action.
+func (e *export) action(round int, a poker.PlayerAction) {
+	name := e.name(a.Position)
+
+	var line string
+	switch act := a.Action.(type) {
+	case poker.FoldAction:
+		e.folded[a.Position] = round
+		line = "folds"
+	case poker.CheckAction:
+		line = "checks"
+	case poker.CallAction:
+		e.put(a.Position, act.Amount)
+		line = "calls " + formatAmount(act.Amount)
+	case poker.BetAction:
+		e.put(a.Position, act.Amount)
+		line = "bets " + formatAmount(act.Amount)
+	case poker.RaiseAction:
+		prev := e.highest
+		e.put(a.Position, act.Amount)
+		line = fmt.Sprintf("raises %v to %v", formatAmount(e.highest-prev),
+			formatAmount(e.highest))
+	default:
+		return
+	}
+
+	if e.stack[a.Position] == 0 && line != "folds" && line != "checks" {
+		line += " and is all-in"
+	}
+	e.printf("%v: %v", name, line)
+}
+
+// returnUncalled writes the part of the last bet that nobody called.
+func (e *export) returnUncalled() {
+	var first, second poker.Amount
+	var pos poker.PlayerPosition
+	for p, a := range e.street {
+		if a > first {
+			second = first
+			first = a
+			pos = p
+		} else if a > second {
+			second = a
+		}
+	}
+
+	if first == second {
+		return
+	}
+
+	uncalled := first - second
+	e.stack[pos] += uncalled
+	e.total[pos] -= uncalled
+	e.printf("Uncalled bet (%v) returned to %v", formatAmount(uncalled),
+		e.name(pos))
+}
+
+// contenders returns the players who have not folded.
+func (e *export) contenders() (ret []poker.PlayerPosition) {
+	for i, p := range e.h.Players {
+		pos := poker.PlayerPosition(i + 1)
+		if p.Name == "" || e.h.sittingOut(pos) {
+			continue
+		}
+		if _, ok := e.folded[pos]; !ok {
+			ret = append(ret, pos)
+		}
+	}
+	return
+}
+
+// pot returns the total amount of chips in the pot.
+func (e *export) pot() (pot poker.Amount) {
+	for _, a := range e.total {
+		pot += a
+	}
+	return
+}
+
+// result writes the showdown and what each player collected.
+func (e *export) result() {
+	contenders := e.contenders()
+
+	e.collected = e.h.Collected
+	if len(e.collected) == 0 && len(contenders) == 1 {
+		e.collected = []Payout{{Position: contenders[0], Amount: e.pot()}}
+	}
+
+	if !e.twice() {
+		if len(contenders) > 1 {
+			e.printf("*** SHOW DOWN ***")
+			e.shows()
+		}
+		e.collect(0)
+		return
+	}
+
+	// The cards are shown once, the pots are collected per board.
+	for i, name := range boardNames {
+		e.printf("*** %v SHOW DOWN ***", name)
+		if i == 0 {
+			e.shows()
+		}
+		e.collect(i)
+	}
+}
+
+// shows writes the hole cards shown and mucked at showdown.
+func (e *export) shows() {
+	for _, c := range e.h.Shown {
+		e.printf("%v: shows %v", e.name(c.Position), formatCards(c.Cards))
+	}
+	for _, c := range e.h.Mucked {
+		e.printf("%v: mucks hand", e.name(c.Position))
+	}
+}
+
+// collect writes what each player collected on a board.
+func (e *export) collect(board int) {
+	for _, c := range e.collected {
+		if c.Board != board {
+			continue
+		}
+		e.printf("%v collected %v from %v", e.name(c.Position),
+			formatAmount(c.Amount), potName(c.Pot, len(e.h.Pots)))
+	}
+}
+
+// won returns the total amount collected by a player.
+func (e *export) won(pos poker.PlayerPosition) (won poker.Amount) {
+	for _, c := range e.collected {
+		if c.Position == pos {
+			won += c.Amount
+		}
+	}
+	return
+}
+
+// findCards returns the cards of a player in the list, or nil.
+func findCards(list []poker.PlayerCards,
+	pos poker.PlayerPosition) *poker.PlayerCards {
+
+	for i := range list {
+		if list[i].Position == pos {
+			return &list[i]
+		}
+	}
+	return nil
+}
+
+// summary writes the summary block.
+func (e *export) summary() {
+	e.printf("*** SUMMARY ***")
+
+	pots := ""
+	if len(e.h.Pots) > 1 {
+		for i, p := range e.h.Pots {
+			name := "Main pot"
+			if i > 0 {
+				name = "S" + potName(i, len(e.h.Pots))[1:]
+			}
+			pots += fmt.Sprintf(" %v %v.", name, formatAmount(p))
+		}
+	}
+	e.printf("Total pot %v%v | Rake %v", formatAmount(e.pot()), pots,
+		formatAmount(e.h.Rake))
+
+	if e.twice() {
+		e.printf("Hand was run twice")
+		for i, b := range e.h.Boards {
+			e.printf("%v Board %v", boardNames[i], formatCards(b))
+		}
+	} else if n := len(e.h.Rounds); n > 0 && len(e.h.Rounds[n-1].Cards) != 0 {
+		e.printf("Board %v", formatCards(e.h.Rounds[n-1].Cards))
+	}
+
+	for i, p := range e.h.Players {
+		pos := poker.PlayerPosition(i + 1)
+		// Players who sit out are not listed.
+		if p.Name == "" || e.h.sittingOut(pos) {
+			continue
+		}
+		won := e.won(pos)
+
+		line := fmt.Sprintf("Seat %v: %v", i+1, p.Name)
+		// Heads-up, the button is also the small blind.
+		if pos == e.h.Button {
+			line += " (button)"
+		}
+		if pos == e.h.SmallBlind {
+			line += " (small blind)"
+		} else if pos == e.h.BigBlind {
+			line += " (big blind)"
+		}
+
+		if round, ok := e.folded[pos]; ok {
+			if round == 0 {
+				line += " folded before Flop"
+				if e.total[pos] == 0 {
+					line += " (didn't bet)"
+				}
+			} else {
+				line += " folded on the " + streetNames[round]
+			}
+		} else if c := findCards(e.h.Shown, pos); c != nil {
+			line += " showed " + formatCards(c.Cards)
+			if won > 0 {
+				line += fmt.Sprintf(" and won (%v)", formatAmount(won))
+			} else {
+				line += " and lost"
+			}
+		} else if c := findCards(e.h.Mucked, pos); c != nil {
+			line += " mucked"
+			if len(c.Cards) != 0 {
+				line += " " + formatCards(c.Cards)
+			}
+		} else if won > 0 {
+			line += fmt.Sprintf(" collected (%v)", formatAmount(won))
+		}
+
+		e.printf("%v", line)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// Session files
+////////////////////////////////////////////////////////////////////////////////
+
+// Exporter writes hands to hand-history files, one file per table per
+// session.
+type Exporter struct {
+	dir   string
+	start time.Time
+	files map[string]*os.File
+}
+
+// NewExporter creates an exporter which writes its files to the given
+// directory.
+func NewExporter(dir string) *Exporter {
+	return &Exporter{
+		dir:   dir,
+		start: time.Now(),
+		files: make(map[string]*os.File),
+	}
+}
+
+// Export appends a hand to the file of its table.
+func (ex *Exporter) Export(h *Hand) error {
+	f, err := ex.file(h.Table)
+	if err != nil {
+		return err
+	}
+
+	// PokerStars separates hands by two empty lines.
+	var buf bytes.Buffer
+	if err := Write(&buf, h); err != nil {
+		return err
+	}
+	buf.WriteString("\n\n")
+
+	if _, err := f.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// Close closes all files.
+func (ex *Exporter) Close() error {
+	var err error
+	for name, f := range ex.files {
+		if e := f.Close(); e != nil && err == nil {
+			err = e
+		}
+		delete(ex.files, name)
+	}
+	return err
+}
+
+// file returns the open file of a table, creating it if needed.
+func (ex *Exporter) file(t poker.Table) (*os.File, error) {
+	if f, ok := ex.files[t.Name]; ok {
+		return f, nil
+	}
+
+	if err := os.MkdirAll(ex.dir, os.ModePerm); err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(filepath.Join(ex.dir, fileName(ex.start, t)),
+		os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	ex.files[t.Name] = f
+	return f, nil
+}
+
+// fileName returns the name of the hand-history file of a table, in the
+// style of the PokerStars client (e.g. "HH20170101 143000 Aaltje II -
+// $0.01-$0.02 - No Limit Hold'em.txt").
+func fileName(start time.Time, t poker.Table) string {
+	name := fmt.Sprintf("HH%v %v - %v-%v - %v.txt", start.Format("20060102 150405"),
+		t.Name, formatAmount(t.Stakes.SmallBlind),
+		formatAmount(t.Stakes.BigBlind), t.Game)
+
+	// Remove characters which are not allowed in file names.
+	return strings.Map(func(r rune) rune {
+		if strings.ContainsRune(`<>:"/\|?*`, r) {
+			return '_'
+		}
+		return r
+	}, name)
+}
@@ -0,0 +1,408 @@
+package handhistory
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/whomever000/poker-common"
+	"github.com/whomever000/poker-common/card"
+)
+
+// amount parses an amount, failing the test on error.
+func amount(t *testing.T, s string) poker.Amount {
+	a, err := poker.ParseAmount(s)
+	if err != nil {
+		t.Fatalf("Failed to parse amount %v: %v", s, err)
+	}
+	return a
+}
+
+// cards parses a space separated list of cards, failing the test on error.
+func cards(t *testing.T, s string) []card.Card {
+	var ret []card.Card
+	for _, str := range strings.Fields(s) {
+		c, err := card.ParseCard(str)
+		if err != nil {
+			t.Fatalf("Failed to parse card %v: %v", str, err)
+		}
+		ret = append(ret, c)
+	}
+	return ret
+}
+
+// newTestHand returns a hand header without any betting rounds.
+func newTestHand(t *testing.T, size int, stakes string) *Hand {
+	s, err := poker.ParseStakes(stakes)
+	if err != nil {
+		t.Fatalf("Failed to parse stakes: %v", err)
+	}
+	g, err := poker.ParseGame("No Limit Hold'em")
+	if err != nil {
+		t.Fatalf("Failed to parse game: %v", err)
+	}
+
+	return &Hand{Hand: poker.Hand{
+		Client: "PokerStars",
+		Table: poker.Table{
+			Name:   "Aaltje II",
+			Stakes: s,
+			Size:   size,
+			Game:   g,
+		},
+		HandID: 123456789,
+		Date:   poker.Date(time.Date(2017, 1, 1, 12, 0, 0, 0, easternTime())),
+	}}
+}
+
+// act returns a player action.
+func act(pos int, a poker.Action) poker.PlayerAction {
+	return poker.PlayerAction{Position: poker.PlayerPosition(pos), Action: a}
+}
+
+// foldedHand returns a 6-max hand which ends on the turn when everyone folds
+// to a bet.
+func foldedHand(t *testing.T) *Hand {
+	h := newTestHand(t, 6, "$0.01/$0.02")
+	h.Button = 3
+	h.SmallBlind = 4
+	h.BigBlind = 5
+	h.ThisPlayer = &poker.PlayerCards{Position: 4, Cards: cards(t, "Ah Kd")}
+	h.Players = []poker.Player{
+		{Name: "alice", Stack: amount(t, "2")},
+		{Name: "bob", Stack: amount(t, "1.94")},
+		{Name: "carol", Stack: amount(t, "1.21")},
+		{Name: "dave", Stack: amount(t, "3.26")},
+		{Name: "erin", Stack: amount(t, "1.51")},
+		{Name: "frank", Stack: amount(t, "4")},
+	}
+	h.Rounds = []poker.Round{{
+		Actions: []poker.PlayerAction{
+			act(6, poker.NewFoldAction()),
+			act(1, poker.NewRaiseAction(amount(t, "0.06"))),
+			act(2, poker.NewCallAction(amount(t, "0.06"))),
+			act(3, poker.NewFoldAction()),
+			act(4, poker.NewCallAction(amount(t, "0.05"))),
+			act(5, poker.NewFoldAction()),
+		},
+	}, {
+		Cards: cards(t, "2c 3d 4h"),
+		Actions: []poker.PlayerAction{
+			act(4, poker.NewCheckAction()),
+			act(1, poker.NewBetAction(amount(t, "0.10"))),
+			act(2, poker.NewCallAction(amount(t, "0.10"))),
+			act(4, poker.NewFoldAction()),
+		},
+	}, {
+		Cards: cards(t, "2c 3d 4h 5s"),
+		Actions: []poker.PlayerAction{
+			act(1, poker.NewBetAction(amount(t, "0.30"))),
+			act(2, poker.NewFoldAction()),
+		},
+	}}
+	return h
+}
+
+const foldedHandText = `PokerStars Hand #123456789:  Hold'em No Limit ($0.01/$0.02) - 2017/01/01 12:00:00 ET
+Table 'Aaltje II' 6-max Seat #3 is the button
+Seat 1: alice ($2 in chips)
+Seat 2: bob ($1.94 in chips)
+Seat 3: carol ($1.21 in chips)
+Seat 4: dave ($3.26 in chips)
+Seat 5: erin ($1.51 in chips)
+Seat 6: frank ($4 in chips)
+dave: posts small blind $0.01
+erin: posts big blind $0.02
+*** HOLE CARDS ***
+Dealt to dave [Ah Kd]
+frank: folds
+alice: raises $0.04 to $0.06
+bob: calls $0.06
+carol: folds
+dave: calls $0.05
+erin: folds
+*** FLOP *** [2c 3d 4h]
+dave: checks
+alice: bets $0.10
+bob: calls $0.10
+dave: folds
+*** TURN *** [2c 3d 4h] [5s]
+alice: bets $0.30
+bob: folds
+Uncalled bet ($0.30) returned to alice
+alice collected $0.40 from pot
+*** SUMMARY ***
+Total pot $0.40 | Rake $0
+Board [2c 3d 4h 5s]
+Seat 1: alice collected ($0.40)
+Seat 2: bob folded on the Turn
+Seat 3: carol (button) folded before Flop (didn't bet)
+Seat 4: dave (small blind) folded on the Flop
+Seat 5: erin (big blind) folded before Flop
+Seat 6: frank folded before Flop (didn't bet)
+`
+
+// allInHand returns a heads-up hand where both players are all-in preflop and
+// bob wins the showdown with a straight.
+func allInHand(t *testing.T) *Hand {
+	h := newTestHand(t, 2, "$0.01/$0.02")
+	h.Button = 1
+	h.SmallBlind = 1
+	h.BigBlind = 2
+	h.Players = []poker.Player{
+		{Name: "alice", Stack: amount(t, "1")},
+		{Name: "bob", Stack: amount(t, "0.50")},
+	}
+	h.Rounds = []poker.Round{{
+		Actions: []poker.PlayerAction{
+			act(1, poker.NewRaiseAction(amount(t, "0.99"))),
+			act(2, poker.NewCallAction(amount(t, "0.48"))),
+		},
+	}, {
+		Cards: cards(t, "2c 3d 4h"),
+	}, {
+		Cards: cards(t, "2c 3d 4h 5s"),
+	}, {
+		Cards: cards(t, "2c 3d 4h 5s Kc"),
+	}}
+	h.Shown = []poker.PlayerCards{
+		{Position: 1, Cards: cards(t, "Qs Qh")},
+		{Position: 2, Cards: cards(t, "Ah Kd")},
+	}
+	h.Collected = []Payout{{Position: 2, Amount: amount(t, "1")}}
+	h.Pots = []poker.Amount{amount(t, "1")}
+	return h
+}
+
+const allInHandText = `PokerStars Hand #123456789:  Hold'em No Limit ($0.01/$0.02) - 2017/01/01 12:00:00 ET
+Table 'Aaltje II' 2-max Seat #1 is the button
+Seat 1: alice ($1 in chips)
+Seat 2: bob ($0.50 in chips)
+alice: posts small blind $0.01
+bob: posts big blind $0.02
+*** HOLE CARDS ***
+alice: raises $0.98 to $1 and is all-in
+bob: calls $0.48 and is all-in
+Uncalled bet ($0.50) returned to alice
+*** FLOP *** [2c 3d 4h]
+*** TURN *** [2c 3d 4h] [5s]
+*** RIVER *** [2c 3d 4h 5s] [Kc]
+*** SHOW DOWN ***
+alice: shows [Qs Qh]
+bob: shows [Ah Kd]
+bob collected $1 from pot
+*** SUMMARY ***
+Total pot $1 | Rake $0
+Board [2c 3d 4h 5s Kc]
+Seat 1: alice (button) (small blind) showed [Qs Qh] and lost
+Seat 2: bob (big blind) showed [Ah Kd] and won ($1)
+`
+
+// postedHand returns a 4-max hand where a player posts both blinds to come
+// in, and everyone folds to a bet on the flop.
+func postedHand(t *testing.T) *Hand {
+	h := newTestHand(t, 4, "$0.01/$0.02")
+	h.Button = 1
+	h.SmallBlind = 2
+	h.BigBlind = 3
+	h.Players = []poker.Player{
+		{Name: "alice", Stack: amount(t, "1")},
+		{Name: "bob", Stack: amount(t, "1")},
+		{Name: "carol", Stack: amount(t, "1")},
+		{Name: "dave", Stack: amount(t, "1")},
+	}
+	h.Rounds = []poker.Round{{
+		Actions: []poker.PlayerAction{
+			act(2, PostAction{PostSmallBlind, amount(t, "0.01")}),
+			act(3, PostAction{PostBigBlind, amount(t, "0.02")}),
+			act(4, PostAction{PostBothBlinds, amount(t, "0.03")}),
+			act(4, poker.NewCheckAction()),
+			act(1, poker.NewFoldAction()),
+			act(2, poker.NewCallAction(amount(t, "0.01"))),
+			act(3, poker.NewCheckAction()),
+		},
+	}, {
+		Cards: cards(t, "2c 3d 4h"),
+		Actions: []poker.PlayerAction{
+			act(2, poker.NewBetAction(amount(t, "0.06"))),
+			act(3, poker.NewFoldAction()),
+			act(4, poker.NewFoldAction()),
+		},
+	}}
+	return h
+}
+
+const postedHandText = `PokerStars Hand #123456789:  Hold'em No Limit ($0.01/$0.02) - 2017/01/01 12:00:00 ET
+Table 'Aaltje II' 4-max Seat #1 is the button
+Seat 1: alice ($1 in chips)
+Seat 2: bob ($1 in chips)
+Seat 3: carol ($1 in chips)
+Seat 4: dave ($1 in chips)
+bob: posts small blind $0.01
+carol: posts big blind $0.02
+dave: posts small & big blinds $0.03
+*** HOLE CARDS ***
+dave: checks
+alice: folds
+bob: calls $0.01
+carol: checks
+*** FLOP *** [2c 3d 4h]
+bob: bets $0.06
+carol: folds
+dave: folds
+Uncalled bet ($0.06) returned to bob
+bob collected $0.07 from pot
+*** SUMMARY ***
+Total pot $0.07 | Rake $0
+Board [2c 3d 4h]
+Seat 1: alice (button) folded before Flop (didn't bet)
+Seat 2: bob (small blind) collected ($0.07)
+Seat 3: carol (big blind) folded on the Flop
+Seat 4: dave folded on the Flop
+`
+
+func TestWrite(t *testing.T) {
+	tests := []struct {
+		name string
+		hand *Hand
+		text string
+	}{
+		{"folded", foldedHand(t), foldedHandText},
+		{"allIn", allInHand(t), allInHandText},
+		{"posted", postedHand(t), postedHandText},
+	}
+
+	for _, test := range tests {
+		var buf bytes.Buffer
+		if err := Write(&buf, test.hand); err != nil {
+			t.Errorf("%v: Failed to write: %v", test.name, err)
+			continue
+		}
+
+		if buf.String() != test.text {
+			t.Errorf("%v: expected\n%v\ngot\n%v", test.name, test.text,
+				buf.String())
+		}
+	}
+}
+
+// TestWriteRoundTrip verifies that the hands the exporter writes read back as
+// the same hands, which write the same text again.
+func TestWriteRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		hand *Hand
+	}{
+		{"folded", foldedHand(t)},
+		{"allIn", allInHand(t)},
+		{"posted", postedHand(t)},
+	}
+
+	for _, test := range tests {
+		var first bytes.Buffer
+		if err := Write(&first, test.hand); err != nil {
+			t.Errorf("%v: Failed to write: %v", test.name, err)
+			continue
+		}
+		hands, err := Parse(strings.NewReader(first.String()))
+		if err != nil {
+			t.Errorf("%v: Failed to parse: %v", test.name, err)
+			continue
+		}
+		if len(hands) != 1 {
+			t.Errorf("%v: Expected 1 hand, got %v", test.name, len(hands))
+			continue
+		}
+
+		var second bytes.Buffer
+		if err := Write(&second, hands[0]); err != nil {
+			t.Errorf("%v: Failed to write again: %v", test.name, err)
+			continue
+		}
+		if second.String() != first.String() {
+			t.Errorf("%v: expected\n%v\ngot\n%v", test.name, first.String(),
+				second.String())
+		}
+	}
+}
+
+// TestWriteSittingOut verifies that players who sit out are listed in the
+// seats but not in the summary.
+func TestWriteSittingOut(t *testing.T) {
+	h := allInHand(t)
+	h.Players = append(h.Players, poker.Player{Name: "carol", Stack: amount(t, "2")})
+	h.Status = []string{"active", "active", StatusSittingOut}
+
+	var buf bytes.Buffer
+	if err := Write(&buf, h); err != nil {
+		t.Fatalf("Failed to write: %v", err)
+	}
+	text := buf.String()
+	if !strings.Contains(text, "Seat 3: carol ($2 in chips) is sitting out\n") {
+		t.Errorf("Expected carol to sit out, got\n%v", text)
+	}
+	if i := strings.Index(text, "*** SUMMARY ***"); strings.Contains(text[i:], "carol") {
+		t.Errorf("Expected carol not to be in the summary, got\n%v", text)
+	}
+}
+
+func TestFormatAmount(t *testing.T) {
+	tests := []struct {
+		amount string
+		text   string
+	}{
+		{"0", "$0"},
+		{"0.02", "$0.02"},
+		{"0.5", "$0.50"},
+		{"2", "$2"},
+		{"1.94", "$1.94"},
+		{"100", "$100"},
+	}
+
+	for _, test := range tests {
+		if s := formatAmount(amount(t, test.amount)); s != test.text {
+			t.Errorf("For %v expected %v, got %v", test.amount, test.text, s)
+		}
+	}
+}
+
+func TestExporter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "handhistory")
+	if err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	ex := NewExporter(dir)
+	for _, h := range []*Hand{foldedHand(t), foldedHand(t)} {
+		if err := ex.Export(h); err != nil {
+			t.Fatalf("Failed to export: %v", err)
+		}
+	}
+	if err := ex.Close(); err != nil {
+		t.Fatalf("Failed to close: %v", err)
+	}
+
+	// Both hands are of the same table, so they end up in the same file.
+	ls, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("Failed to list directory: %v", err)
+	}
+	if len(ls) != 1 {
+		t.Fatalf("Expected 1 file, got %v", len(ls))
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(dir, ls[0].Name()))
+	if err != nil {
+		t.Fatalf("Failed to read file: %v", err)
+	}
+
+	expected := foldedHandText + "\n\n" + foldedHandText + "\n\n"
+	if string(b) != expected {
+		t.Errorf("Expected\n%v\ngot\n%v", expected, string(b))
+	}
+}
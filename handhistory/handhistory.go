@@ -0,0 +1,254 @@
+// Package handhistory contains functions for writing and reading hands in the
+// native PokerStars hand-history text format. This is the format written by
+// the PokerStars client itself and read by third-party trackers.
+package handhistory
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/whomever000/poker-common"
+	"github.com/whomever000/poker-common/card"
+)
+
+// Hand is a hand as it appears in a hand history. It extends poker.Hand with
+// the outcome of the hand, which poker.Hand has no room for.
+type Hand struct {
+	poker.Hand
+
+	// ID is our own number of the hand, counting the hands of a table from 1.
+	// HandID is the number of the hand on the site, or if it could not be
+	// read, our own number which is unique across the tables. Parse leaves
+	// ID 0.
+	ID int
+
+	// Shown are the hole cards shown at showdown.
+	Shown []poker.PlayerCards
+	// Mucked are the players who mucked at showdown. Cards are only known
+	// for this player.
+	Mucked []poker.PlayerCards
+	// Uncalled are the bets returned because nobody called them. Filled in
+	// by Parse, Write works these out from the actions.
+	Uncalled []Payout
+	// Collected are the amounts won from the pots. Uncalled, Collected, Pots
+	// and Rake make up the result of the hand, see Resolve.
+	Collected []Payout
+	// Pots are the main pot followed by the side pots, after rake.
+	Pots []poker.Amount
+	// Rake is the amount taken by the site.
+	Rake poker.Amount
+	// Boards are the two boards of a hand which was run twice, empty
+	// otherwise. The rounds then hold the first board.
+	Boards [][]card.Card
+	// Status is the state of each seat at the start of the hand, indexed
+	// like Players, e.g. "sitting out". Parse only fills in the seats of
+	// players who sit out.
+	Status []string
+	// Uncertain are the fields which were read with a confidence below the
+	// threshold, e.g. "Players[2].Stack". They are not exported.
+	Uncertain []string
+	// Readings are the readings of regions which were read from several
+	// images, in the order they were read. They are not exported.
+	Readings []Reading
+}
+
+// Reading is how a region was read from consecutive images until it was
+// stable, e.g. the stack of a player while the chips move.
+type Reading struct {
+	// Region is the region read, without the seat, e.g. "plStack".
+	Region string
+	// Frames is the number of images read, and Stable whether enough of them
+	// agreed.
+	Frames int
+	Stable bool
+}
+
+// Payout is an amount paid out to a player.
+type Payout struct {
+	Position poker.PlayerPosition
+	Amount   poker.Amount
+	// Pot is the index of the pot in Hand.Pots the amount came from.
+	Pot int
+	// Board is the index of the board in Hand.Boards the amount was won on,
+	// if the hand was run twice.
+	Board int
+}
+
+// Post is the kind of a forced bet.
+type Post int
+
+// The forced bets. A player who missed the blinds posts both, of which only
+// the big blind counts towards their bet. Antes never count towards a bet.
+const (
+	PostSmallBlind Post = iota + 1
+	PostBigBlind
+	PostBothBlinds
+	PostStraddle
+	PostAnte
+)
+
+// postNames are the forced bets as written in hand histories, after "posts".
+var postNames = map[Post]string{
+	PostSmallBlind: "small blind",
+	PostBigBlind:   "big blind",
+	PostBothBlinds: "small & big blinds",
+	PostStraddle:   "straddle",
+	PostAnte:       "the ante",
+}
+
+// PostAction is a forced bet, posted before the cards are dealt. poker.Hand
+// has no action for it, so hands read from the table or from hand histories
+// hold these among the actions of the first betting round. Without them, the
+// blinds are the ones of the stakes, posted by SmallBlind and BigBlind.
+type PostAction struct {
+	Post   Post
+	Amount poker.Amount
+}
+
+func (a PostAction) String() string {
+	return fmt.Sprintf("posts %v %v", postNames[a.Post], formatAmount(a.Amount))
+}
+
+// Live returns the part of a forced bet which counts towards the bet of the
+// player in the first betting round.
+func (a PostAction) Live(stakes poker.Stakes) poker.Amount {
+	switch a.Post {
+	case PostAnte:
+		return 0
+	case PostBothBlinds:
+		return stakes.BigBlind
+	}
+	return a.Amount
+}
+
+// Posts returns the forced bets of a hand, antes first.
+func (h *Hand) Posts() (ret []poker.PlayerAction) {
+	if len(h.Rounds) == 0 {
+		return nil
+	}
+	for _, ante := range []bool{true, false} {
+		for _, a := range h.Rounds[0].Actions {
+			if p, ok := a.Action.(PostAction); ok && (p.Post == PostAnte) == ante {
+				ret = append(ret, a)
+			}
+		}
+	}
+	return ret
+}
+
+// StatusSittingOut is the status of a seat whose player sits out.
+const StatusSittingOut = "sitting out"
+
+// sittingOut returns whether the player at a position sits out, and so is not
+// dealt in.
+func (h *Hand) sittingOut(pos poker.PlayerPosition) bool {
+	i := int(pos) - 1
+	return i >= 0 && i < len(h.Status) && h.Status[i] == StatusSittingOut
+}
+
+// dateLayout is the layout of the date in the hand header.
+const dateLayout = "2006/01/02 15:04:05"
+
+// streetNames are the names of the betting rounds as they appear in hand
+// histories.
+var streetNames = []string{"Preflop", "Flop", "Turn", "River"}
+
+// boardNames are the names of the boards of a hand which was run twice.
+var boardNames = []string{"FIRST", "SECOND"}
+
+// limits are the betting structures which PokerStars writes after the game
+// in the hand header (e.g. "Hold'em No Limit").
+var limits = []string{"No Limit", "Pot Limit", "Limit"}
+
+// easternTime returns the time zone PokerStars uses in hand histories.
+func easternTime() *time.Location {
+	loc, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		return time.FixedZone("ET", -5*60*60)
+	}
+	return loc
+}
+
+// formatAmount formats an amount the way PokerStars does, e.g. "$2" or
+// "$0.15".
+func formatAmount(a poker.Amount) string {
+	sign := ""
+	if a < 0 {
+		sign = "-"
+		a = -a
+	}
+	if a%100 == 0 {
+		return fmt.Sprintf("%v$%d", sign, int(a/100))
+	}
+	return fmt.Sprintf("%v$%d.%02d", sign, int(a/100), int(a%100))
+}
+
+// formatCards formats cards as a space separated list in brackets, e.g.
+// "[Ah Kd]".
+func formatCards(cards []card.Card) string {
+	strs := make([]string, len(cards))
+	for i, c := range cards {
+		strs[i] = c.String()
+	}
+	return "[" + strings.Join(strs, " ") + "]"
+}
+
+// parseAmount parses an amount as written in hand histories, e.g. "$1.50" or
+// "1,500".
+func parseAmount(s string) (poker.Amount, error) {
+	s = strings.TrimPrefix(s, "$")
+	s = strings.Replace(s, ",", "", -1)
+	return poker.ParseAmount(s)
+}
+
+// parseCards parses a space separated list of cards, e.g. "Ah Kd".
+func parseCards(s string) ([]card.Card, error) {
+	var cards []card.Card
+	for _, str := range strings.Fields(s) {
+		c, err := card.ParseCard(str)
+		if err != nil {
+			return nil, err
+		}
+		cards = append(cards, c)
+	}
+	return cards, nil
+}
+
+// potName returns the name of a pot as used in "collected" lines, given the
+// total number of pots.
+func potName(pot, pots int) string {
+	switch {
+	case pots <= 1:
+		return "pot"
+	case pot == 0:
+		return "main pot"
+	case pots == 2:
+		return "side pot"
+	}
+	return fmt.Sprintf("side pot-%v", pot)
+}
+
+// headerGame returns the game as written in the hand header, i.e. with the
+// betting structure moved to the end ("No Limit Hold'em" becomes
+// "Hold'em No Limit").
+func headerGame(g poker.Game) string {
+	name := g.String()
+	for _, l := range limits {
+		if strings.HasPrefix(name, l+" ") {
+			return strings.TrimPrefix(name, l+" ") + " " + l
+		}
+	}
+	return name
+}
+
+// parseGame parses the game as written in the hand header.
+func parseGame(s string) (poker.Game, error) {
+	for _, l := range limits {
+		if strings.HasSuffix(s, " "+l) {
+			s = l + " " + strings.TrimSuffix(s, " "+l)
+			break
+		}
+	}
+	return poker.ParseGame(s)
+}
@@ -0,0 +1,661 @@
+package handhistory
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/whomever000/poker-common"
+	"github.com/whomever000/poker-common/card"
+)
+
+// ParseError is returned when a hand history is malformed.
+type ParseError struct {
+	// Line is the line number, starting at 1.
+	Line int
+	// Text is the content of the line.
+	Text string
+	Msg  string
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("line %v: %v: %q", e.Line, e.Msg, e.Text)
+}
+
+var (
+	reHeader = regexp.MustCompile(
+		`^PokerStars (?:Zoom )?Hand #(\d+):\s+(.+?) \((\S+)/(\S+?)(?: [A-Z]{3})?\) - (.+)$`)
+	reDate  = regexp.MustCompile(`(\d{4}/\d{2}/\d{2} \d{1,2}:\d{2}:\d{2}) ET`)
+	reTable = regexp.MustCompile(
+		`^Table '(.+)' (\d+)-max(?: \(Play Money\))? Seat #(\d+) is the button$`)
+	reSeat = regexp.MustCompile(
+		`^Seat (\d+): (.+) \((\S+) in chips(?:, .+)?\)( is sitting out| out of hand.*)?$`)
+	reCards    = regexp.MustCompile(`\[([^\]]*)\]`)
+	reUncalled = regexp.MustCompile(`^Uncalled bet \((\S+)\) returned to (.+)$`)
+	reCollect  = regexp.MustCompile(
+		`^ collected (\S+) from (?:(main|side) )?pot(?:-(\d+))?$`)
+	reTotal   = regexp.MustCompile(`^Total pot (\S+)`)
+	reSidePot = regexp.MustCompile(`(?:Main|Side) pot(?:-\d+)? (\S+?)\.(?: |$)`)
+	reRake    = regexp.MustCompile(`\| Rake (\S+)`)
+	reMucked  = regexp.MustCompile(`^Seat (\d+): .* mucked \[([^\]]*)\]`)
+
+	// reChatter matches lines about players which have nothing to do with the
+	// hand itself.
+	reChatter = regexp.MustCompile(`^.+?:? (?:joins the table at seat #\d+|` +
+		`leaves the table|is disconnected|is connected|` +
+		`has timed out(?: while disconnected)?|has returned|` +
+		`will be allowed to play after the button|` +
+		`was removed from the table.*|is sitting out|sits out|said, ".*")$`)
+)
+
+// section is the part of the hand history a line belongs to.
+type section int
+
+const (
+	sectionSeats section = iota
+	sectionRounds
+	sectionShowdown
+	sectionSummary
+)
+
+// parser holds the state needed while reading hand histories.
+type parser struct {
+	hands []*Hand
+	h     *Hand
+
+	line    int
+	text    string
+	section section
+
+	// Positions of the players by name.
+	names map[string]poker.PlayerPosition
+
+	// Chips put in by each player in the current round and in total.
+	street map[poker.PlayerPosition]poker.Amount
+	total  map[poker.PlayerPosition]poker.Amount
+
+	// Forced bets, which are posted before the first betting round.
+	posts []poker.PlayerAction
+
+	// Board of the current showdown of a hand which was run twice.
+	board int
+}
+
+// Parse reads all hands from a PokerStars hand-history file. Hands are
+// separated by empty lines. A *ParseError is returned for malformed input.
+func Parse(r io.Reader) ([]*Hand, error) {
+	p := &parser{}
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		p.line++
+		p.text = strings.TrimRight(scanner.Text(), "\r")
+		if p.line == 1 {
+			p.text = strings.TrimPrefix(p.text, "\ufeff")
+		}
+
+		if err := p.parseLine(); err != nil {
+			return nil, err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if err := p.finish(); err != nil {
+		return nil, err
+	}
+
+	return p.hands, nil
+}
+
+func (p *parser) errorf(format string, a ...interface{}) error {
+	return &ParseError{
+		Line: p.line,
+		Text: p.text,
+		Msg:  fmt.Sprintf(format, a...),
+	}
+}
+
+// finish adds the current hand to the list of hands.
+func (p *parser) finish() error {
+	if p.h == nil {
+		return nil
+	}
+	if p.section != sectionSummary {
+		return p.errorf("unexpected end of hand #%v", p.h.HandID)
+	}
+
+	p.hands = append(p.hands, p.h)
+	p.h = nil
+	return nil
+}
+
+// parseLine parses the current line.
+func (p *parser) parseLine() error {
+	line := p.text
+
+	if strings.TrimSpace(line) == "" {
+		return nil
+	}
+
+	if strings.HasPrefix(line, "PokerStars ") {
+		if err := p.finish(); err != nil {
+			return err
+		}
+		return p.parseHeader()
+	}
+
+	if p.h == nil {
+		return p.errorf("expected hand header")
+	}
+
+	if strings.HasPrefix(line, "*** ") {
+		return p.parseMarker()
+	}
+
+	if p.section == sectionSummary {
+		return p.parseSummary()
+	}
+
+	if p.section == sectionSeats {
+		if m := reTable.FindStringSubmatch(line); m != nil {
+			return p.parseTable(m)
+		}
+		if m := reSeat.FindStringSubmatch(line); m != nil {
+			return p.parseSeat(m)
+		}
+	}
+
+	if reChatter.MatchString(line) {
+		return nil
+	}
+
+	if m := reUncalled.FindStringSubmatch(line); m != nil {
+		return p.parseUncalled(m[1], m[2])
+	}
+
+	if p.section == sectionRounds && strings.HasPrefix(line, "Dealt to ") {
+		return p.parseDealt()
+	}
+
+	pos, rest, ok := p.player(line)
+	if !ok {
+		return p.errorf("unexpected line")
+	}
+
+	if m := reCollect.FindStringSubmatch(rest); m != nil {
+		return p.parseCollect(pos, m)
+	}
+
+	if !strings.HasPrefix(rest, ": ") {
+		return p.errorf("unexpected line")
+	}
+	return p.parseAction(pos, rest[2:])
+}
+
+// player finds the player a line starts with. It returns the player's
+// position and the remainder of the line.
+func (p *parser) player(line string) (poker.PlayerPosition, string, bool) {
+	var name string
+	for n := range p.names {
+		if len(n) > len(name) && strings.HasPrefix(line, n) &&
+			len(line) > len(n) && (line[len(n)] == ':' || line[len(n)] == ' ') {
+			name = n
+		}
+	}
+	if name == "" {
+		return 0, "", false
+	}
+	return p.names[name], line[len(name):], true
+}
+
+// put moves chips from a player's stack into the pot.
+func (p *parser) put(pos poker.PlayerPosition, amount poker.Amount) {
+	p.street[pos] += amount
+	p.total[pos] += amount
+}
+
+// pot returns the total amount of chips in the pot.
+func (p *parser) pot() (pot poker.Amount) {
+	for _, a := range p.total {
+		pot += a
+	}
+	return
+}
+
+// round returns the current betting round.
+func (p *parser) round() *poker.Round {
+	return &p.h.Rounds[len(p.h.Rounds)-1]
+}
+
+// addAction adds an action to the current betting round.
+func (p *parser) addAction(pos poker.PlayerPosition, a poker.Action) error {
+	if len(p.h.Rounds) == 0 || p.section != sectionRounds {
+		return p.errorf("action outside of a betting round")
+	}
+	r := p.round()
+	r.Actions = append(r.Actions, poker.PlayerAction{Position: pos, Action: a})
+	return nil
+}
+
+// amount parses an amount, returning a ParseError on failure.
+func (p *parser) amount(s string) (poker.Amount, error) {
+	a, err := parseAmount(s)
+	if err != nil {
+		return 0, p.errorf("invalid amount %v: %v", s, err)
+	}
+	return a, nil
+}
+
+// cards parses all groups of cards in brackets in s.
+func (p *parser) cards(s string) ([][]card.Card, error) {
+	var ret [][]card.Card
+	for _, m := range reCards.FindAllStringSubmatch(s, -1) {
+		cards, err := parseCards(m[1])
+		if err != nil {
+			return nil, p.errorf("invalid cards: %v", err)
+		}
+		ret = append(ret, cards)
+	}
+	return ret, nil
+}
+
+// parseHeader parses the first line of a hand.
+func (p *parser) parseHeader() error {
+	m := reHeader.FindStringSubmatch(p.text)
+	if m == nil {
+		return p.errorf("invalid hand header")
+	}
+
+	p.h = new(Hand)
+	p.section = sectionSeats
+	p.board = 0
+	p.names = make(map[string]poker.PlayerPosition)
+	p.street = make(map[poker.PlayerPosition]poker.Amount)
+	p.total = make(map[poker.PlayerPosition]poker.Amount)
+	p.posts = nil
+
+	h := p.h
+	h.Client = "PokerStars"
+
+	id, err := strconv.Atoi(m[1])
+	if err != nil {
+		return p.errorf("invalid hand ID: %v", err)
+	}
+	h.HandID = id
+
+	h.Table.Game, err = parseGame(m[2])
+	if err != nil {
+		return p.errorf("invalid game: %v", err)
+	}
+
+	h.Table.Stakes, err = poker.ParseStakes(m[3] + "/" + m[4])
+	if err != nil {
+		return p.errorf("invalid stakes: %v", err)
+	}
+
+	d := reDate.FindStringSubmatch(m[5])
+	if d == nil {
+		return p.errorf("missing ET date")
+	}
+	date, err := time.ParseInLocation(dateLayout, d[1], easternTime())
+	if err != nil {
+		return p.errorf("invalid date: %v", err)
+	}
+	h.Date = poker.Date(date)
+
+	return nil
+}
+
+// parseTable parses the table line.
+func (p *parser) parseTable(m []string) error {
+	size, err := strconv.Atoi(m[2])
+	if err != nil {
+		return p.errorf("invalid table size: %v", err)
+	}
+	button, err := strconv.Atoi(m[3])
+	if err != nil {
+		return p.errorf("invalid button: %v", err)
+	}
+
+	p.h.Table.Name = m[1]
+	p.h.Table.Size = size
+	p.h.Button = poker.PlayerPosition(button)
+	return nil
+}
+
+// parseSeat parses a seat line of the hand header.
+func (p *parser) parseSeat(m []string) error {
+	seat, err := strconv.Atoi(m[1])
+	if err != nil || seat < 1 {
+		return p.errorf("invalid seat")
+	}
+	stack, err := p.amount(m[3])
+	if err != nil {
+		return err
+	}
+
+	for len(p.h.Players) < seat {
+		p.h.Players = append(p.h.Players, poker.Player{})
+	}
+	p.h.Players[seat-1] = poker.Player{Name: m[2], Stack: stack}
+	p.names[m[2]] = poker.PlayerPosition(seat)
+
+	if m[4] == " is sitting out" {
+		for len(p.h.Status) < seat {
+			p.h.Status = append(p.h.Status, "")
+		}
+		p.h.Status[seat-1] = StatusSittingOut
+	}
+	return nil
+}
+
+// parseDealt parses the hole cards dealt to 'me'.
+func (p *parser) parseDealt() error {
+	pos, rest, ok := p.player(strings.TrimPrefix(p.text, "Dealt to "))
+	if !ok {
+		return p.errorf("unknown player")
+	}
+
+	cards, err := p.cards(rest)
+	if err != nil {
+		return err
+	}
+	if len(cards) == 0 {
+		return nil
+	}
+
+	p.h.ThisPlayer = &poker.PlayerCards{Position: pos, Cards: cards[0]}
+	return nil
+}
+
+// parseMarker parses a line starting a new section, e.g. "*** FLOP ***".
+func (p *parser) parseMarker() error {
+	line := p.text
+
+	newRound := func() error {
+		if p.section != sectionRounds {
+			return p.errorf("unexpected betting round")
+		}
+		cards, err := p.cards(line)
+		if err != nil {
+			return err
+		}
+
+		var r poker.Round
+		for _, c := range cards {
+			r.Cards = append(r.Cards, c...)
+		}
+		r.Pot = p.pot()
+
+		p.h.Rounds = append(p.h.Rounds, r)
+		p.street = make(map[poker.PlayerPosition]poker.Amount)
+		return nil
+	}
+
+	switch {
+	case line == "*** HOLE CARDS ***":
+		if p.section != sectionSeats {
+			return p.errorf("unexpected hole cards")
+		}
+		p.section = sectionRounds
+		p.h.Rounds = append(p.h.Rounds,
+			poker.Round{Pot: p.pot(), Actions: p.posts})
+		return nil
+
+	case strings.HasPrefix(line, "*** FLOP *** "),
+		strings.HasPrefix(line, "*** TURN *** "),
+		strings.HasPrefix(line, "*** RIVER *** "),
+		strings.HasPrefix(line, "*** FIRST FLOP *** "),
+		strings.HasPrefix(line, "*** FIRST TURN *** "),
+		strings.HasPrefix(line, "*** FIRST RIVER *** "):
+		return newRound()
+
+	case strings.HasPrefix(line, "*** SECOND FLOP *** "),
+		strings.HasPrefix(line, "*** SECOND TURN *** "),
+		strings.HasPrefix(line, "*** SECOND RIVER *** "):
+		// The second board is read from the summary.
+		if p.section != sectionRounds {
+			return p.errorf("unexpected betting round")
+		}
+		_, err := p.cards(line)
+		return err
+
+	case line == "*** SHOW DOWN ***", line == "*** FIRST SHOW DOWN ***":
+		if p.section != sectionRounds {
+			return p.errorf("unexpected showdown")
+		}
+		p.section = sectionShowdown
+		return nil
+
+	case line == "*** SECOND SHOW DOWN ***":
+		if p.section != sectionShowdown {
+			return p.errorf("unexpected showdown")
+		}
+		p.board = 1
+		return nil
+
+	case line == "*** SUMMARY ***":
+		if p.section != sectionRounds && p.section != sectionShowdown {
+			return p.errorf("unexpected summary")
+		}
+		p.section = sectionSummary
+		return nil
+	}
+
+	return p.errorf("unknown section")
+}
+
+// parseAction parses what a player did.
+func (p *parser) parseAction(pos poker.PlayerPosition, action string) error {
+
+	// The amount is the first word after the verb.
+	field := func(i int) (poker.Amount, error) {
+		f := strings.Fields(action)
+		if len(f) <= i {
+			return 0, p.errorf("missing amount")
+		}
+		return p.amount(f[i])
+	}
+
+	// post adds a forced bet whose amount is the i-th word. Only its live
+	// part counts towards the bet, e.g. the small blind of both blinds is
+	// dead.
+	post := func(kind Post, i int) error {
+		a, err := field(i)
+		if err != nil {
+			return err
+		}
+		post := PostAction{Post: kind, Amount: a}
+		live := post.Live(p.h.Table.Stakes)
+		p.put(pos, live)
+		p.total[pos] += a - live
+		p.posts = append(p.posts, poker.PlayerAction{Position: pos, Action: post})
+		return nil
+	}
+
+	switch {
+	case strings.HasPrefix(action, "posts small blind "):
+		p.h.SmallBlind = pos
+		return post(PostSmallBlind, 3)
+
+	case strings.HasPrefix(action, "posts big blind "):
+		p.h.BigBlind = pos
+		return post(PostBigBlind, 3)
+
+	case strings.HasPrefix(action, "posts small & big blinds "):
+		return post(PostBothBlinds, 5)
+
+	case strings.HasPrefix(action, "posts straddle "):
+		return post(PostStraddle, 2)
+
+	case strings.HasPrefix(action, "posts the ante "):
+		return post(PostAnte, 3)
+
+	case action == "folds" || strings.HasPrefix(action, "folds ["):
+		return p.addAction(pos, poker.NewFoldAction())
+
+	case action == "checks":
+		return p.addAction(pos, poker.NewCheckAction())
+
+	case strings.HasPrefix(action, "calls "):
+		a, err := field(1)
+		if err != nil {
+			return err
+		}
+		p.put(pos, a)
+		return p.addAction(pos, poker.NewCallAction(a))
+
+	case strings.HasPrefix(action, "bets "):
+		a, err := field(1)
+		if err != nil {
+			return err
+		}
+		p.put(pos, a)
+		return p.addAction(pos, poker.NewBetAction(a))
+
+	case strings.HasPrefix(action, "raises "):
+		// "raises $0.04 to $0.06", the amount put in is what it takes to
+		// get from the player's current bet to the new one.
+		to, err := field(3)
+		if err != nil {
+			return err
+		}
+		a := to - p.street[pos]
+		p.put(pos, a)
+		return p.addAction(pos, poker.NewRaiseAction(a))
+
+	case strings.HasPrefix(action, "shows "):
+		cards, err := p.cards(action)
+		if err != nil {
+			return err
+		}
+		if len(cards) == 0 {
+			return p.errorf("missing cards")
+		}
+		p.h.Shown = append(p.h.Shown,
+			poker.PlayerCards{Position: pos, Cards: cards[0]})
+
+	case action == "mucks hand":
+		p.h.Mucked = append(p.h.Mucked, poker.PlayerCards{Position: pos})
+
+	case action == "doesn't show hand":
+
+	default:
+		return p.errorf("unknown action")
+	}
+
+	return nil
+}
+
+// parseUncalled parses the return of an uncalled bet.
+func (p *parser) parseUncalled(amount, name string) error {
+	a, err := p.amount(amount)
+	if err != nil {
+		return err
+	}
+	pos, ok := p.names[name]
+	if !ok {
+		return p.errorf("unknown player")
+	}
+
+	p.street[pos] -= a
+	p.total[pos] -= a
+	p.h.Uncalled = append(p.h.Uncalled, Payout{Position: pos, Amount: a})
+	return nil
+}
+
+// parseCollect parses what a player collected from a pot.
+func (p *parser) parseCollect(pos poker.PlayerPosition, m []string) error {
+	a, err := p.amount(m[1])
+	if err != nil {
+		return err
+	}
+
+	pot := 0
+	if m[2] == "side" {
+		pot = 1
+		if m[3] != "" {
+			pot, _ = strconv.Atoi(m[3])
+		}
+	}
+
+	p.h.Collected = append(p.h.Collected,
+		Payout{Position: pos, Amount: a, Pot: pot, Board: p.board})
+	return nil
+}
+
+// parseSummary parses a line of the summary block.
+func (p *parser) parseSummary() error {
+	line := p.text
+
+	if m := reTotal.FindStringSubmatch(line); m != nil {
+		total, err := p.amount(m[1])
+		if err != nil {
+			return err
+		}
+
+		if r := reRake.FindStringSubmatch(line); r != nil {
+			if p.h.Rake, err = p.amount(r[1]); err != nil {
+				return err
+			}
+		}
+
+		for _, s := range reSidePot.FindAllStringSubmatch(line, -1) {
+			a, err := p.amount(s[1])
+			if err != nil {
+				return err
+			}
+			p.h.Pots = append(p.h.Pots, a)
+		}
+		if len(p.h.Pots) == 0 {
+			p.h.Pots = []poker.Amount{total - p.h.Rake}
+		}
+		return nil
+	}
+
+	if m := reMucked.FindStringSubmatch(line); m != nil {
+		seat, _ := strconv.Atoi(m[1])
+		cards, err := parseCards(m[2])
+		if err != nil {
+			return p.errorf("invalid cards: %v", err)
+		}
+		c := findCards(p.h.Mucked, poker.PlayerPosition(seat))
+		if c == nil {
+			p.h.Mucked = append(p.h.Mucked,
+				poker.PlayerCards{Position: poker.PlayerPosition(seat)})
+			c = &p.h.Mucked[len(p.h.Mucked)-1]
+		}
+		c.Cards = cards
+		return nil
+	}
+
+	for i, name := range boardNames {
+		if strings.HasPrefix(line, name+" Board ") {
+			cards, err := p.cards(line)
+			if err != nil {
+				return err
+			}
+			if len(cards) == 0 {
+				return p.errorf("missing cards")
+			}
+			for len(p.h.Boards) <= i {
+				p.h.Boards = append(p.h.Boards, nil)
+			}
+			p.h.Boards[i] = cards[0]
+			return nil
+		}
+	}
+
+	if strings.HasPrefix(line, "Board ") || strings.HasPrefix(line, "Seat ") ||
+		line == "Hand was run twice" {
+		return nil
+	}
+
+	return p.errorf("unexpected summary line")
+}
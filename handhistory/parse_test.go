@@ -0,0 +1,392 @@
+package handhistory
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/whomever000/poker-common"
+)
+
+const showdownHandText = `PokerStars Hand #200000001:  Hold'em No Limit ($0.05/$0.10) - 2017/01/02 20:15:30 ET
+Table 'Aaltje II' 6-max Seat #1 is the button
+Seat 1: alice ($10 in chips)
+Seat 2: bob ($2 in chips)
+Seat 3: carol ($10 in chips)
+bob: posts small blind $0.05
+carol: posts big blind $0.10
+*** HOLE CARDS ***
+Dealt to alice [Ah Ad]
+alice: raises $0.20 to $0.30
+bob: raises $1.70 to $2 and is all-in
+carol: calls $1.90
+alice: calls $1.70
+*** FLOP *** [2c 7d 9h]
+carol: bets $1
+alice: calls $1
+*** TURN *** [2c 7d 9h] [Js]
+carol: checks
+alice: checks
+*** RIVER *** [2c 7d 9h Js] [Kc]
+carol: checks
+alice: checks
+*** SHOW DOWN ***
+alice: shows [Ah Ad]
+bob: shows [Kd Ks]
+carol: mucks hand
+alice collected $2 from side pot
+bob collected $5.70 from main pot
+*** SUMMARY ***
+Total pot $8 Main pot $5.70. Side pot $2. | Rake $0.30
+Board [2c 7d 9h Js Kc]
+Seat 1: alice (button) showed [Ah Ad] and won ($2)
+Seat 2: bob (small blind) showed [Kd Ks] and won ($5.70)
+Seat 3: carol (big blind) mucked
+`
+
+const runTwiceHandText = `PokerStars Hand #200000002:  Hold'em No Limit ($0.05/$0.10) - 2017/01/02 20:20:00 ET
+Table 'Aaltje II' 6-max Seat #1 is the button
+Seat 1: alice ($10 in chips)
+Seat 2: bob ($10 in chips)
+alice: posts small blind $0.05
+bob: posts big blind $0.10
+*** HOLE CARDS ***
+Dealt to alice [Ah Ad]
+alice: raises $0.20 to $0.30
+bob: calls $0.20
+*** FLOP *** [2c 7d 9h]
+bob: bets $9.70 and is all-in
+alice: calls $9.70 and is all-in
+*** FIRST TURN *** [2c 7d 9h] [Js]
+*** FIRST RIVER *** [2c 7d 9h Js] [Kc]
+*** SECOND TURN *** [2c 7d 9h] [Qd]
+*** SECOND RIVER *** [2c 7d 9h Qd] [9c]
+*** FIRST SHOW DOWN ***
+bob: shows [9s 9d]
+alice: shows [Ah Ad]
+bob collected $9.75 from pot
+*** SECOND SHOW DOWN ***
+bob collected $9.75 from pot
+*** SUMMARY ***
+Total pot $20 | Rake $0.50
+Hand was run twice
+FIRST Board [2c 7d 9h Js Kc]
+SECOND Board [2c 7d 9h Qd 9c]
+Seat 1: alice (button) (small blind) showed [Ah Ad] and lost
+Seat 2: bob (big blind) showed [9s 9d] and won ($19.50)
+`
+
+const postsHandText = `PokerStars Hand #200000003:  Hold'em No Limit ($0.01/$0.02) - 2017/01/02 20:25:00 ET
+Table 'Aaltje II' 6-max Seat #1 is the button
+Seat 1: alice ($1 in chips)
+Seat 2: bob ($1 in chips)
+Seat 3: carol ($1 in chips)
+Seat 4: dave ($1 in chips)
+Seat 5: erin ($1 in chips)
+alice: posts the ante $0.01
+bob: posts the ante $0.01
+carol: posts the ante $0.01
+dave: posts the ante $0.01
+erin: posts the ante $0.01
+bob: posts small blind $0.01
+carol: posts big blind $0.02
+dave: posts straddle $0.04
+erin: posts small & big blinds $0.03
+*** HOLE CARDS ***
+erin: calls $0.02
+alice: folds
+bob: folds
+carol: folds
+dave: checks
+*** FLOP *** [2c 3d 4h]
+dave: bets $0.10
+erin: folds
+Uncalled bet ($0.10) returned to dave
+dave collected $0.17 from pot
+*** SUMMARY ***
+Total pot $0.17 | Rake $0
+Board [2c 3d 4h]
+Seat 1: alice (button) folded before Flop
+Seat 2: bob (small blind) folded before Flop
+Seat 3: carol (big blind) folded before Flop
+Seat 4: dave collected ($0.17)
+Seat 5: erin folded on the Flop
+`
+
+// TestRoundTrip parses hand histories and writes them again.
+func TestRoundTrip(t *testing.T) {
+	texts := map[string]string{
+		"folded":   foldedHandText,
+		"allIn":    allInHandText,
+		"showdown": showdownHandText,
+		"runTwice": runTwiceHandText,
+		"posts":    postsHandText,
+	}
+
+	for name, text := range texts {
+		hands, err := Parse(strings.NewReader(text))
+		if err != nil {
+			t.Errorf("%v: Failed to parse: %v", name, err)
+			continue
+		}
+		if len(hands) != 1 {
+			t.Errorf("%v: Expected 1 hand, got %v", name, len(hands))
+			continue
+		}
+
+		var buf bytes.Buffer
+		if err := Write(&buf, hands[0]); err != nil {
+			t.Errorf("%v: Failed to write: %v", name, err)
+			continue
+		}
+
+		if buf.String() != text {
+			t.Errorf("%v: expected\n%v\ngot\n%v", name, text, buf.String())
+		}
+	}
+}
+
+// TestRoundTripHand writes a hand and parses it again.
+func TestRoundTripHand(t *testing.T) {
+	h := foldedHand(t)
+
+	var buf bytes.Buffer
+	if err := Write(&buf, h); err != nil {
+		t.Fatalf("Failed to write: %v", err)
+	}
+	hands, err := Parse(&buf)
+	if err != nil {
+		t.Fatalf("Failed to parse: %v", err)
+	}
+	if len(hands) != 1 {
+		t.Fatalf("Expected 1 hand, got %v", len(hands))
+	}
+	got := hands[0]
+
+	if !time.Time(got.Date).Equal(time.Time(h.Date)) {
+		t.Errorf("Expected date %v, got %v", time.Time(h.Date),
+			time.Time(got.Date))
+	}
+	got.Date = h.Date
+
+	// Parse fills in what Write works out by itself.
+	h.Rounds[0].Actions = append([]poker.PlayerAction{
+		act(4, PostAction{PostSmallBlind, amount(t, "0.01")}),
+		act(5, PostAction{PostBigBlind, amount(t, "0.02")}),
+	}, h.Rounds[0].Actions...)
+	h.Uncalled = []Payout{{Position: 1, Amount: amount(t, "0.30")}}
+	h.Collected = []Payout{{Position: 1, Amount: amount(t, "0.40")}}
+	h.Pots = []poker.Amount{amount(t, "0.40")}
+	h.Rounds[0].Pot = amount(t, "0.03")
+	h.Rounds[1].Pot = amount(t, "0.20")
+	h.Rounds[2].Pot = amount(t, "0.40")
+
+	if !reflect.DeepEqual(got, h) {
+		t.Errorf("Expected\n%+v\ngot\n%+v", h, got)
+	}
+}
+
+const clientHandsText = "\ufeff" + `PokerStars Hand #167000000001:  Hold'em No Limit ($0.01/$0.02 USD) - 2017/03/04 2:05:06 CET [2017/03/03 20:05:06 ET]
+Table 'Aaltje II' 6-max Seat #2 is the button
+Seat 1: alice ($1.50 in chips)
+Seat 2: bob ($0.80 in chips)
+Seat 3: carol ($2.10 in chips)
+Seat 5: dave ($1 in chips) is sitting out
+carol: posts small blind $0.01
+alice: posts big blind $0.02
+*** HOLE CARDS ***
+Dealt to carol [Td Tc]
+dave leaves the table
+bob: raises $0.78 to $0.80 and is all-in
+carol: raises $1.30 to $2.10 and is all-in
+alice: calls $1.48 and is all-in
+Uncalled bet ($0.60) returned to carol
+*** FLOP *** [2c 7d 9h]
+*** TURN *** [2c 7d 9h] [Js]
+alice said, "gl"
+*** RIVER *** [2c 7d 9h Js] [Kc]
+*** SHOW DOWN ***
+carol: shows [Td Tc] (a pair of Tens)
+alice: shows [As Qs] (high card Ace)
+bob: shows [8c 8d] (a pair of Eights)
+carol collected $1.40 from side pot
+carol collected $2.30 from main pot
+*** SUMMARY ***
+Total pot $3.80 Main pot $2.30. Side pot $1.40. | Rake $0.10
+Board [2c 7d 9h Js Kc]
+Seat 1: alice (big blind) showed [As Qs] and lost with high card Ace
+Seat 2: bob (button) showed [8c 8d] and lost with a pair of Eights
+Seat 3: carol (small blind) showed [Td Tc] and won ($3.70) with a pair of Tens
+
+
+
+PokerStars Hand #167000000002:  Hold'em No Limit ($0.01/$0.02 USD) - 2017/03/03 20:06:00 ET
+Table 'Aaltje II' 6-max Seat #3 is the button
+Seat 1: alice ($1.50 in chips)
+Seat 3: carol ($3.70 in chips)
+carol: posts small blind $0.01
+alice: posts big blind $0.02
+*** HOLE CARDS ***
+Dealt to carol [2h 7c]
+carol: folds
+Uncalled bet ($0.01) returned to alice
+alice collected $0.02 from pot
+alice: doesn't show hand
+*** SUMMARY ***
+Total pot $0.02 | Rake $0
+Seat 1: alice (big blind) collected ($0.02)
+Seat 3: carol (button) (small blind) folded before Flop
+`
+
+// TestParse parses hands as written by the PokerStars client.
+func TestParse(t *testing.T) {
+	hands, err := Parse(strings.NewReader(clientHandsText))
+	if err != nil {
+		t.Fatalf("Failed to parse: %v", err)
+	}
+	if len(hands) != 2 {
+		t.Fatalf("Expected 2 hands, got %v", len(hands))
+	}
+
+	h := hands[0]
+	if h.HandID != 167000000001 {
+		t.Errorf("Expected hand ID 167000000001, got %v", h.HandID)
+	}
+	date := time.Date(2017, 3, 3, 20, 5, 6, 0, easternTime())
+	if !time.Time(h.Date).Equal(date) {
+		t.Errorf("Expected date %v, got %v", date, time.Time(h.Date))
+	}
+	if h.Table.Name != "Aaltje II" || h.Table.Size != 6 {
+		t.Errorf("Unexpected table %+v", h.Table)
+	}
+	if h.Button != 2 || h.SmallBlind != 3 || h.BigBlind != 1 {
+		t.Errorf("Unexpected button %v, small blind %v, big blind %v",
+			h.Button, h.SmallBlind, h.BigBlind)
+	}
+	if len(h.Players) != 5 || h.Players[4].Name != "dave" ||
+		h.Players[3].Name != "" {
+		t.Errorf("Unexpected players %+v", h.Players)
+	}
+	if len(h.Status) != 5 || h.Status[4] != StatusSittingOut {
+		t.Errorf("Expected dave to sit out, got %q", h.Status)
+	}
+	if h.ThisPlayer == nil || h.ThisPlayer.Position != 3 ||
+		formatCards(h.ThisPlayer.Cards) != "[Td Tc]" {
+		t.Errorf("Unexpected hole cards %+v", h.ThisPlayer)
+	}
+
+	actions := []poker.PlayerAction{
+		act(3, PostAction{PostSmallBlind, amount(t, "0.01")}),
+		act(1, PostAction{PostBigBlind, amount(t, "0.02")}),
+		act(2, poker.NewRaiseAction(amount(t, "0.80"))),
+		act(3, poker.NewRaiseAction(amount(t, "2.09"))),
+		act(1, poker.NewCallAction(amount(t, "1.48"))),
+	}
+	if len(h.Rounds) != 4 {
+		t.Fatalf("Expected 4 rounds, got %v", len(h.Rounds))
+	}
+	if !reflect.DeepEqual(h.Rounds[0].Actions, actions) {
+		t.Errorf("Expected actions %v, got %v", actions, h.Rounds[0].Actions)
+	}
+	if formatCards(h.Rounds[3].Cards) != "[2c 7d 9h Js Kc]" {
+		t.Errorf("Unexpected board %v", h.Rounds[3].Cards)
+	}
+	if h.Rounds[1].Pot != amount(t, "3.80") {
+		t.Errorf("Expected flop pot $3.80, got %v", formatAmount(h.Rounds[1].Pot))
+	}
+
+	uncalled := []Payout{{Position: 3, Amount: amount(t, "0.60")}}
+	if !reflect.DeepEqual(h.Uncalled, uncalled) {
+		t.Errorf("Expected uncalled %v, got %v", uncalled, h.Uncalled)
+	}
+	if len(h.Shown) != 3 {
+		t.Errorf("Expected 3 shown hands, got %v", len(h.Shown))
+	}
+	collected := []Payout{
+		{Position: 3, Amount: amount(t, "1.40"), Pot: 1},
+		{Position: 3, Amount: amount(t, "2.30"), Pot: 0},
+	}
+	if !reflect.DeepEqual(h.Collected, collected) {
+		t.Errorf("Expected collected %v, got %v", collected, h.Collected)
+	}
+	pots := []poker.Amount{amount(t, "2.30"), amount(t, "1.40")}
+	if !reflect.DeepEqual(h.Pots, pots) {
+		t.Errorf("Expected pots %v, got %v", pots, h.Pots)
+	}
+	if h.Rake != amount(t, "0.10") {
+		t.Errorf("Expected rake $0.10, got %v", formatAmount(h.Rake))
+	}
+
+	h = hands[1]
+	collected = []Payout{{Position: 1, Amount: amount(t, "0.02")}}
+	if !reflect.DeepEqual(h.Collected, collected) {
+		t.Errorf("Expected collected %v, got %v", collected, h.Collected)
+	}
+	if len(h.Rounds) != 1 || len(h.Rounds[0].Actions) != 3 {
+		t.Errorf("Unexpected rounds %+v", h.Rounds)
+	}
+}
+
+// TestParseRunTwice verifies that both boards of a hand which was run twice
+// are read, and on which board each pot was won.
+func TestParseRunTwice(t *testing.T) {
+	hands, err := Parse(strings.NewReader(runTwiceHandText))
+	if err != nil {
+		t.Fatalf("Failed to parse: %v", err)
+	}
+	h := hands[0]
+
+	if len(h.Rounds) != 4 || formatCards(h.Rounds[3].Cards) != "[2c 7d 9h Js Kc]" {
+		t.Errorf("Unexpected rounds %+v", h.Rounds)
+	}
+	if len(h.Boards) != 2 || formatCards(h.Boards[0]) != "[2c 7d 9h Js Kc]" ||
+		formatCards(h.Boards[1]) != "[2c 7d 9h Qd 9c]" {
+		t.Errorf("Unexpected boards %v", h.Boards)
+	}
+
+	collected := []Payout{
+		{Position: 2, Amount: amount(t, "9.75"), Board: 0},
+		{Position: 2, Amount: amount(t, "9.75"), Board: 1},
+	}
+	if !reflect.DeepEqual(h.Collected, collected) {
+		t.Errorf("Expected collected %v, got %v", collected, h.Collected)
+	}
+}
+
+// TestParseError verifies that malformed input is reported with its line.
+func TestParseError(t *testing.T) {
+	header := "PokerStars Hand #1:  Hold'em No Limit ($0.01/$0.02) - " +
+		"2017/01/01 12:00:00 ET\n" +
+		"Table 'Aaltje II' 6-max Seat #1 is the button\n" +
+		"Seat 1: alice ($1 in chips)\n"
+
+	tests := []struct {
+		name string
+		text string
+		line int
+	}{
+		{"noHeader", "garbage\n", 1},
+		{"badHeader", "PokerStars Hand #x\n", 1},
+		{"badStack", header + "Seat 2: bob ($x in chips)\n", 4},
+		{"unknownPlayer", header + "*** HOLE CARDS ***\nbob: folds\n", 5},
+		{"unknownAction", header + "*** HOLE CARDS ***\nalice: dances\n", 5},
+		{"badCards", header + "*** HOLE CARDS ***\n*** FLOP *** [Xx]\n", 5},
+		{"actionBeforeCards", header + "alice: folds\n", 4},
+		{"noSummary", header + "*** HOLE CARDS ***\nalice: folds\n", 5},
+	}
+
+	for _, test := range tests {
+		_, err := Parse(strings.NewReader(test.text))
+		perr, ok := err.(*ParseError)
+		if !ok {
+			t.Errorf("%v: Expected a ParseError, got %v", test.name, err)
+			continue
+		}
+		if perr.Line != test.line {
+			t.Errorf("%v: Expected line %v, got %v (%v)", test.name, test.line,
+				perr.Line, perr)
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package handhistory
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+	"unicode"
+
+	"github.com/whomever000/poker-common"
+)
+
+// RakeSchedule is the rake the site takes, per game and stakes. It is read
+// from a file like res/references/rake.json.
+type RakeSchedule struct {
+	// games are the levels of the schedule by the key of their game.
+	games map[string][]rakeLevel
+}
+
+// rakeLevel is the rake at one stakes. Rake is a percentage of the pot, the
+// caps are in dollars by the number of players dealt in.
+type rakeLevel struct {
+	Stakes string
+	Rake   float64
+	Max2   float64
+	Max34  float64
+	Max5p  float64
+
+	stakes poker.Stakes
+}
+
+// rakeTolerance is how much the rake taken may differ from the schedule. The
+// site rounds fractions of a cent, which the schedule does not say how.
+const rakeTolerance = 1
+
+// ReadRakeSchedule reads a rake schedule. The games in the file are named
+// without spaces and punctuation, e.g. "NoLimitHoldEm".
+func ReadRakeSchedule(r io.Reader) (*RakeSchedule, error) {
+	if r == nil {
+		return nil, fmt.Errorf("no rake schedule")
+	}
+
+	var games map[string][]rakeLevel
+	if err := json.NewDecoder(r).Decode(&games); err != nil {
+		return nil, fmt.Errorf("failed to decode rake schedule. %v", err)
+	}
+
+	rs := &RakeSchedule{games: make(map[string][]rakeLevel)}
+	for game, levels := range games {
+		for i := range levels {
+			s, err := poker.ParseStakes(levels[i].Stakes)
+			if err != nil {
+				return nil, fmt.Errorf("bad stakes %q in rake schedule. %v",
+					levels[i].Stakes, err)
+			}
+			levels[i].stakes = s
+		}
+		rs.games[gameKey(game)] = levels
+	}
+	return rs, nil
+}
+
+// Expected returns the rake the schedule takes from a hand, and false if the
+// schedule has no rake for the game and stakes of the hand, e.g. for play
+// money. Nothing is taken from a hand which ended before the flop.
+func (rs *RakeSchedule) Expected(h *Hand) (poker.Amount, bool) {
+	l, ok := rs.level(h.Table)
+	if !ok {
+		return 0, false
+	}
+
+	// No flop, no drop.
+	if len(h.Rounds) < 2 || len(h.Rounds[1].Cards) == 0 {
+		return 0, true
+	}
+
+	put, street, _ := contributions(h)
+	_, uncalled := unmatched(street)
+	pot := -uncalled
+	for _, a := range put {
+		pot += a
+	}
+
+	dealt := 0
+	for i, p := range h.Players {
+		if p.Name != "" && !h.sittingOut(poker.PlayerPosition(i+1)) {
+			dealt++
+		}
+	}
+	max := l.Max5p
+	switch {
+	case dealt <= 2:
+		max = l.Max2
+	case dealt <= 4:
+		max = l.Max34
+	}
+
+	rake := poker.Amount(math.Floor(float64(pot) * l.Rake / 100))
+	if c := dollars(max); rake > c {
+		rake = c
+	}
+	return rake, true
+}
+
+// Check returns an error if the rake of a hand, i.e. what is left of the pot
+// after the payouts (see Resolve), is not the rake of the schedule. Hands the
+// schedule has no rake for are not checked.
+func (rs *RakeSchedule) Check(h *Hand) error {
+	expected, ok := rs.Expected(h)
+	if !ok {
+		return nil
+	}
+	if d := h.Rake - expected; d > rakeTolerance || d < -rakeTolerance {
+		return fmt.Errorf("rake %v differs from the expected %v",
+			formatAmount(h.Rake), formatAmount(expected))
+	}
+	return nil
+}
+
+// level returns the level of the schedule for the game and stakes of a table,
+// and whether there is one.
+func (rs *RakeSchedule) level(t poker.Table) (rakeLevel, bool) {
+	for _, l := range rs.games[gameKey(t.Game.String())] {
+		if l.stakes.SmallBlind == t.Stakes.SmallBlind &&
+			l.stakes.BigBlind == t.Stakes.BigBlind {
+			return l, true
+		}
+	}
+	return rakeLevel{}, false
+}
+
+// gameKey returns the name of a game without spaces and punctuation, in lower
+// case, e.g. "nolimitholdem".
+func gameKey(name string) string {
+	return strings.Map(func(r rune) rune {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+			return -1
+		}
+		return unicode.ToLower(r)
+	}, name)
+}
+
+// dollars converts an amount in dollars to cents.
+func dollars(d float64) poker.Amount {
+	return poker.Amount(math.Floor(d*100 + 0.5))
+}
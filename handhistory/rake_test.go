@@ -0,0 +1,79 @@
+package handhistory
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/whomever000/poker-common"
+)
+
+const testRakeSchedule = `{
+	"NoLimitHoldEm":[{
+		"Stakes":"$0.01/$0.02",
+		"Rake"	:3.50,
+		"Max2"	:0.02,
+		"Max34"	:0.05,
+		"Max5p"	:0.30
+	}]
+}`
+
+func TestRakeScheduleExpected(t *testing.T) {
+	rs, err := ReadRakeSchedule(strings.NewReader(testRakeSchedule))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	flop := sidePotHand(t)
+	flop.Rounds = append(flop.Rounds, poker.Round{Cards: cards(t, "2c 3d 4h")})
+
+	tests := []struct {
+		name string
+		hand *Hand
+		rake poker.Amount
+	}{
+		{"folded", foldedHand(t), 1},
+		{"heads-up cap", allInHand(t), 2},
+		{"3-4 player cap", flop, 5},
+		{"no flop", sidePotHand(t), 0},
+	}
+
+	for _, test := range tests {
+		rake, ok := rs.Expected(test.hand)
+		if !ok {
+			t.Errorf("%v: Expected a rake", test.name)
+			continue
+		}
+		if rake != test.rake {
+			t.Errorf("%v: Expected rake %v, got %v", test.name, test.rake, rake)
+		}
+	}
+
+	h := newTestHand(t, 6, "$0.05/$0.10")
+	if _, ok := rs.Expected(h); ok {
+		t.Errorf("Expected no rake for stakes without rake")
+	}
+}
+
+func TestRakeScheduleCheck(t *testing.T) {
+	rs, err := ReadRakeSchedule(strings.NewReader(testRakeSchedule))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := foldedHand(t)
+	h.Rake = 1
+	if err := rs.Check(h); err != nil {
+		t.Errorf("Expected the rake to agree, got %v", err)
+	}
+	h.Rake = 5
+	if err := rs.Check(h); err == nil {
+		t.Errorf("Expected the rake to disagree")
+	}
+
+	// Stakes without rake, e.g. play money, are not checked.
+	h = newTestHand(t, 6, "$0.05/$0.10")
+	h.Rake = 5
+	if err := rs.Check(h); err != nil {
+		t.Errorf("Expected stakes without rake not to be checked, got %v", err)
+	}
+}
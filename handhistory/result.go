@@ -0,0 +1,242 @@
+package handhistory
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/whomever000/poker-common"
+)
+
+// Resolve works out the result of a hand from the stacks of the players
+// before the hand (Players[i].Stack) and after it. It fills in the uncalled
+// bets, the main pot and the side pots, what each player collected from
+// which pot, and the rake. Stacks are indexed like Players.
+//
+// The result is only filled in if the chips are conserved, i.e. if what the
+// players won can be paid out of the pots they took part in. Otherwise an
+// error is returned and the hand is left unchanged.
+func Resolve(h *Hand, stacks []poker.Amount) error {
+	if len(stacks) != len(h.Players) {
+		return fmt.Errorf("got %v stacks for %v players", len(stacks),
+			len(h.Players))
+	}
+
+	put, street, folded := contributions(h)
+
+	// The part of the highest bet which nobody matched is returned.
+	var uncalled []Payout
+	if pos, a := unmatched(street); a > 0 {
+		put[pos] -= a
+		uncalled = append(uncalled, Payout{Position: pos, Amount: a})
+	}
+
+	pots, eligible := sidePots(put, folded)
+	if len(pots) == 0 {
+		return fmt.Errorf("no player contends for the pot")
+	}
+
+	// What a player won is what their stack grew by, not counting what they
+	// put in and got back.
+	won := make(map[poker.PlayerPosition]poker.Amount)
+	for i, p := range h.Players {
+		pos := poker.PlayerPosition(i + 1)
+		w := stacks[i] - p.Stack + put[pos]
+		switch {
+		case w < 0:
+			return fmt.Errorf("chips are not conserved: seat %v lost %v more "+
+				"than they put in", int(pos), formatAmount(-w))
+		case w > 0 && folded[pos]:
+			return fmt.Errorf("chips are not conserved: seat %v won %v after "+
+				"folding", int(pos), formatAmount(w))
+		case w > 0:
+			won[pos] = w
+		}
+	}
+
+	// Winners are paid from the last side pot they are in first. Whatever
+	// is left in the pots is the rake.
+	left := append([]poker.Amount(nil), pots...)
+	var collected []Payout
+	for i := len(pots) - 1; i >= 0; i-- {
+		for _, pos := range eligible[i] {
+			a := won[pos]
+			if a > left[i] {
+				a = left[i]
+			}
+			if a == 0 {
+				continue
+			}
+			won[pos] -= a
+			left[i] -= a
+			collected = append(collected,
+				Payout{Position: pos, Amount: a, Pot: i})
+		}
+	}
+	for pos, a := range won {
+		if a > 0 {
+			return fmt.Errorf("chips are not conserved: seat %v won %v more "+
+				"than the pots they are in", int(pos), formatAmount(a))
+		}
+	}
+
+	var rake poker.Amount
+	for i := range pots {
+		rake += left[i]
+		pots[i] -= left[i]
+	}
+
+	// Payouts are listed from the main pot, as in hand histories.
+	sort.SliceStable(collected, func(i, j int) bool {
+		return collected[i].Pot < collected[j].Pot
+	})
+
+	h.Uncalled = uncalled
+	h.Collected = collected
+	h.Pots = pots
+	h.Rake = rake
+	return nil
+}
+
+// contributions returns how much each player put into the pot, including the
+// forced bets, and which players folded. Street is what each player bet in
+// the last betting round with any action, the only one in which a bet can be
+// left uncalled.
+func contributions(h *Hand) (put, street map[poker.PlayerPosition]poker.Amount,
+	folded map[poker.PlayerPosition]bool) {
+
+	put = make(map[poker.PlayerPosition]poker.Amount)
+	folded = make(map[poker.PlayerPosition]bool)
+
+	last := 0
+	for i, r := range h.Rounds {
+		if len(r.Actions) != 0 {
+			last = i
+		}
+	}
+
+	street = make(map[poker.PlayerPosition]poker.Amount)
+	bet := func(round int, pos poker.PlayerPosition, total, live poker.Amount) {
+		put[pos] += total
+		if round == last {
+			street[pos] += live
+		}
+	}
+
+	if len(h.Posts()) == 0 {
+		if h.SmallBlind != 0 {
+			a := h.Table.Stakes.SmallBlind
+			bet(0, h.SmallBlind, a, a)
+		}
+		if h.BigBlind != 0 {
+			a := h.Table.Stakes.BigBlind
+			bet(0, h.BigBlind, a, a)
+		}
+	}
+
+	for i, r := range h.Rounds {
+		for _, a := range r.Actions {
+			switch act := a.Action.(type) {
+			case PostAction:
+				bet(i, a.Position, act.Amount, act.Live(h.Table.Stakes))
+			case poker.FoldAction:
+				folded[a.Position] = true
+			case poker.CallAction:
+				bet(i, a.Position, act.Amount, act.Amount)
+			case poker.BetAction:
+				bet(i, a.Position, act.Amount, act.Amount)
+			case poker.RaiseAction:
+				bet(i, a.Position, act.Amount, act.Amount)
+			}
+		}
+	}
+
+	// Empty seats and players who sit out take no part in the hand.
+	for i, p := range h.Players {
+		pos := poker.PlayerPosition(i + 1)
+		if p.Name == "" || h.sittingOut(pos) {
+			folded[pos] = true
+		}
+	}
+	return put, street, folded
+}
+
+// unmatched returns the player who bet the most, and how much more that is
+// than anybody else bet.
+func unmatched(bets map[poker.PlayerPosition]poker.Amount) (
+	poker.PlayerPosition, poker.Amount) {
+
+	var first, second poker.Amount
+	var pos poker.PlayerPosition
+	for p, a := range bets {
+		if a > first {
+			second = first
+			first = a
+			pos = p
+		} else if a > second {
+			second = a
+		}
+	}
+	return pos, first - second
+}
+
+// sidePots splits the contributions into the main pot and the side pots, and
+// returns the players eligible for each pot in the order of their seats. A
+// new side pot starts at every amount a player who did not fold went all-in
+// for.
+func sidePots(put map[poker.PlayerPosition]poker.Amount,
+	folded map[poker.PlayerPosition]bool) ([]poker.Amount,
+	[][]poker.PlayerPosition) {
+
+	var levels []poker.Amount
+	seen := make(map[poker.Amount]bool)
+	for pos, a := range put {
+		if !folded[pos] && a > 0 && !seen[a] {
+			seen[a] = true
+			levels = append(levels, a)
+		}
+	}
+	sort.Slice(levels, func(i, j int) bool { return levels[i] < levels[j] })
+
+	var positions []poker.PlayerPosition
+	for pos := range put {
+		positions = append(positions, pos)
+	}
+	sort.Slice(positions, func(i, j int) bool {
+		return positions[i] < positions[j]
+	})
+
+	var pots []poker.Amount
+	var eligible [][]poker.PlayerPosition
+	var prev poker.Amount
+	for _, level := range levels {
+		var pot poker.Amount
+		var in []poker.PlayerPosition
+		for _, pos := range positions {
+			a := put[pos]
+			pot += minAmount(a, level) - minAmount(a, prev)
+			if !folded[pos] && a >= level {
+				in = append(in, pos)
+			}
+		}
+		pots = append(pots, pot)
+		eligible = append(eligible, in)
+		prev = level
+	}
+
+	// Chips of folded players above the last level go to the last pot.
+	if n := len(pots); n > 0 {
+		for _, pos := range positions {
+			if a := put[pos]; a > prev {
+				pots[n-1] += a - prev
+			}
+		}
+	}
+	return pots, eligible
+}
+
+func minAmount(a, b poker.Amount) poker.Amount {
+	if a < b {
+		return a
+	}
+	return b
+}
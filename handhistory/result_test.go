@@ -0,0 +1,132 @@
+package handhistory
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/whomever000/poker-common"
+)
+
+// sidePotHand returns a 3-max hand where two players are all-in for different
+// amounts preflop.
+func sidePotHand(t *testing.T) *Hand {
+	h := newTestHand(t, 3, "$0.01/$0.02")
+	h.Button = 1
+	h.SmallBlind = 2
+	h.BigBlind = 3
+	h.Players = []poker.Player{
+		{Name: "alice", Stack: amount(t, "1")},
+		{Name: "bob", Stack: amount(t, "0.50")},
+		{Name: "carol", Stack: amount(t, "2")},
+	}
+	h.Rounds = []poker.Round{{
+		Actions: []poker.PlayerAction{
+			act(1, poker.NewRaiseAction(amount(t, "1"))),
+			act(2, poker.NewCallAction(amount(t, "0.49"))),
+			act(3, poker.NewCallAction(amount(t, "0.98"))),
+		},
+	}}
+	return h
+}
+
+func TestResolve(t *testing.T) {
+	amounts := func(strs ...string) (ret []poker.Amount) {
+		for _, s := range strs {
+			ret = append(ret, amount(t, s))
+		}
+		return
+	}
+
+	tests := []struct {
+		name      string
+		hand      *Hand
+		stacks    []poker.Amount
+		uncalled  []Payout
+		collected []Payout
+		pots      []poker.Amount
+		rake      poker.Amount
+	}{
+		{
+			"folded", foldedHand(t),
+			amounts("2.24", "1.78", "1.21", "3.20", "1.49", "4"),
+			[]Payout{{Position: 1, Amount: amount(t, "0.30")}},
+			[]Payout{{Position: 1, Amount: amount(t, "0.40")}},
+			amounts("0.40"), 0,
+		},
+		{
+			"all-in", allInHand(t),
+			amounts("1.50", "0"),
+			[]Payout{{Position: 1, Amount: amount(t, "0.50")}},
+			[]Payout{{Position: 1, Amount: amount(t, "1")}},
+			amounts("1"), 0,
+		},
+		{
+			"posted", postedHand(t),
+			amounts("1", "1.05", "0.98", "0.97"),
+			[]Payout{{Position: 2, Amount: amount(t, "0.06")}},
+			[]Payout{{Position: 2, Amount: amount(t, "0.07")}},
+			amounts("0.07"), 0,
+		},
+		{
+			"side pot", sidePotHand(t),
+			amounts("1", "1.45", "1"),
+			nil,
+			[]Payout{
+				{Position: 2, Amount: amount(t, "1.45")},
+				{Position: 1, Amount: amount(t, "1"), Pot: 1},
+			},
+			amounts("1.45", "1"), amount(t, "0.05"),
+		},
+	}
+
+	for _, test := range tests {
+		if err := Resolve(test.hand, test.stacks); err != nil {
+			t.Errorf("%v: %v", test.name, err)
+			continue
+		}
+		h := test.hand
+		if !reflect.DeepEqual(h.Uncalled, test.uncalled) {
+			t.Errorf("%v: Expected uncalled %v, got %v", test.name,
+				test.uncalled, h.Uncalled)
+		}
+		if !reflect.DeepEqual(h.Collected, test.collected) {
+			t.Errorf("%v: Expected collected %v, got %v", test.name,
+				test.collected, h.Collected)
+		}
+		if !reflect.DeepEqual(h.Pots, test.pots) || h.Rake != test.rake {
+			t.Errorf("%v: Expected pots %v and rake %v, got %v and %v",
+				test.name, test.pots, test.rake, h.Pots, h.Rake)
+		}
+	}
+}
+
+// TestResolveConservation verifies that stacks which do not add up are
+// rejected.
+func TestResolveConservation(t *testing.T) {
+	folded := sidePotHand(t)
+	folded.Rounds[0].Actions[2] = act(3, poker.NewFoldAction())
+
+	tests := []struct {
+		name   string
+		hand   *Hand
+		stacks []string
+	}{
+		{"created", sidePotHand(t), []string{"1.10", "1.50", "1"}},
+		{"lost", sidePotHand(t), []string{"1", "1.45", "0.10"}},
+		{"side pot", sidePotHand(t), []string{"0", "2.50", "1"}},
+		{"folded", folded, []string{"0.50", "0", "2.50"}},
+	}
+
+	for _, test := range tests {
+		var stacks []poker.Amount
+		for _, s := range test.stacks {
+			stacks = append(stacks, amount(t, s))
+		}
+		if err := Resolve(test.hand, stacks); err == nil {
+			t.Errorf("%v: Expected an error", test.name)
+		}
+		if test.hand.Collected != nil {
+			t.Errorf("%v: Expected the hand to be unchanged", test.name)
+		}
+	}
+}
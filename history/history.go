@@ -1,14 +1,29 @@
 // Package history contains functions for saving and loading historical
 // image-dumps. This allows for debugging and testing using prefabricated data.
+//
+// An image-dump is a directory per process, ./dump/<pid>/, with PNG files
+// named after the sequence number and description of an image, e.g.
+// "000042_waitForAction.png". The manifest, manifest.jsonl, describes each
+// image on a line of its own in the order they were saved. Images are recorded
+// as key frames, deltas from the image before ("000043_flop.delta.png") or
+// duplicates of it without a file; see Decoder. Corrections of what vision
+// read from the images are kept apart, in labels.jsonl. Dumps of older
+// versions have no manifest and are ordered by the modification times of
+// their files.
 package history
 
 import (
+	"bufio"
+	"encoding/json"
 	"fmt"
 	"image"
 	"image/png"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/whomever000/poker-client-pokerstars/vision"
@@ -16,110 +31,387 @@ import (
 	log "github.com/Sirupsen/logrus"
 )
 
+// manifestName is the name of the manifest in the directory of a dump.
+const manifestName = "manifest.jsonl"
+
 // NewImageSource creates a new historical image source given the process ID
-// (name of sub-folder).
-func NewImageSource(pid int, block bool) vision.ImageSource {
+// (name of sub-folder) and how to replay it.
+func NewImageSource(pid int, r Replay) vision.ImageSource {
 	return &ImageSource{
-		dir:      "./dump/" + fmt.Sprintf("%v", pid) + "/",
-		lastDate: time.Unix(0, 0),
-		block:    block,
+		pid:    pid,
+		replay: r,
 	}
 }
 
 // ImageSource is an image source based on historical image-dumps.
 type ImageSource struct {
-	dir      string
-	lastDate time.Time
-	block    bool
+	pid    int
+	replay Replay
+	listed bool
+	frames []Frame
+	next   int
+	dec    Decoder
+	// prev is when the frame returned last was saved.
+	prev time.Time
 }
 
-// Get returns the next image in the history sequence.
-func (is *ImageSource) Get() image.Image {
+// Get returns the next image in the history sequence, or
+// vision.ErrEndOfStream after the last one. A frame which cannot be read is
+// skipped after its error is returned.
+func (is *ImageSource) Get() (image.Image, error) {
+	if err := is.list(); err != nil {
+		return nil, err
+	}
+	if is.next >= len(is.frames) {
+		return nil, vision.ErrEndOfStream
+	}
+	f := is.frames[is.next]
+	is.next++
 
-	var img image.Image
+	is.wait(f)
+	log.Infof("History: %v", f.Descr)
+
+	img, err := is.dec.Image(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read frame %v. %v", f.Seq, err)
+	}
+	return img, nil
+}
 
-	// Wait for user input
-	if is.block {
+// Frame returns the frame of the image returned last, or before the first
+// image, the frame of the first one.
+func (is *ImageSource) Frame() (Frame, error) {
+	if err := is.list(); err != nil {
+		return Frame{}, err
+	}
+	switch {
+	case is.next > 0:
+		return is.frames[is.next-1], nil
+	case len(is.frames) > 0:
+		return is.frames[0], nil
+	}
+	return Frame{}, vision.ErrEndOfStream
+}
+
+// list lists the frames to replay. A dump which cannot be listed has no
+// frames after the error.
+func (is *ImageSource) list() error {
+	if is.listed {
+		return nil
+	}
+	is.listed = true
+	frames, err := List(is.pid)
+	if err != nil {
+		return err
+	}
+	if frames, err = seek(frames, is.replay); err != nil {
+		return err
+	}
+	is.frames = frames
+	return nil
+}
+
+// wait waits until the frame is due.
+func (is *ImageSource) wait(f Frame) {
+	switch {
+	case is.replay.Step:
+		// Wait for user input
 		var input string
 		fmt.Scanln(&input)
+	case is.replay.Speed > 0 && !is.prev.IsZero():
+		time.Sleep(time.Duration(float64(f.Time.Sub(is.prev)) /
+			is.replay.Speed))
 	}
+	is.prev = f.Time
+}
+
+// Frame is a single image of an image-dump.
+type Frame struct {
+	// Path is the file of the frame. It is empty for duplicates.
+	Path string
+	// Seq is the number of the image in the dump, counting from 1. It is 0
+	// for dumps without a manifest.
+	Seq int
+	// Time is when the image was saved.
+	Time  time.Time
+	Descr string
+	// Table is the name of the table window, HandID the number of the hand
+	// and Phase the phase of the hand the image was taken in. They are
+	// empty for dumps without a manifest.
+	Table  string
+	HandID int
+	Phase  string
+	// Kind is "key", "delta" or "dup". Base is the sequence number of the
+	// frame a delta or duplicate builds on, and Tiles are the tiles of a
+	// delta which changed.
+	Kind  string
+	Base  int
+	Tiles []int
+	// Readings are what vision read from the image when it was recorded, by
+	// region, and Labels the corrections of them (see AddLabels).
+	Readings map[string]string
+	Labels   map[string]string
 
-	// List files in directory
-	ls, err := ioutil.ReadDir(is.dir)
+	base *Frame
+}
+
+// Image reads and decodes the image of the frame, along with the frames it
+// builds on.
+func (f Frame) Image() (image.Image, error) {
+	var d Decoder
+	return d.Image(f)
+}
+
+// entry is a line of the manifest.
+type entry struct {
+	Seq int
+	// Time is in nanoseconds since the Unix epoch.
+	Time   int64
+	Descr  string
+	Table  string
+	HandID int
+	Phase  string
+	File   string `json:",omitempty"`
+	// Kind is empty for key frames, which all frames were before there were
+	// deltas.
+	Kind  string `json:",omitempty"`
+	Base  int    `json:",omitempty"`
+	Tiles []int  `json:",omitempty"`
+
+	Readings map[string]string `json:",omitempty"`
+}
+
+// dumpDir returns the directory of the image-dump of the given process ID.
+func dumpDir(pid int) string {
+	return "./dump/" + fmt.Sprintf("%v", pid) + "/"
+}
+
+// List returns the frames of the image-dump of the given process ID in the
+// order they were saved.
+func List(pid int) ([]Frame, error) {
+	dir := dumpDir(pid)
+
+	f, err := os.Open(dir + manifestName)
+	if os.IsNotExist(err) {
+		return listModTime(dir)
+	}
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
+	defer f.Close()
 
-	// Iterate files and find the next in the sequence.
-	var fileInfo os.FileInfo
-	for _, f := range ls {
-		// Check if file is older than last evaluated file
-		if fileInfo == nil || f.ModTime().Before(fileInfo.ModTime()) {
-			// Check if file is newer than last returned file
-			if f.ModTime().After(is.lastDate) {
-				fileInfo = f
-			}
-		}
+	labels, err := readLabels(dir)
+	if err != nil {
+		return nil, err
 	}
 
-	// Verify that an image was found
-	if fileInfo == nil {
-		log.Info("End of history sequence")
-		return vision.Image()
+	var frames []Frame
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		if len(strings.TrimSpace(scanner.Text())) == 0 {
+			continue
+		}
+		var e entry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return nil, fmt.Errorf("%v:%v: %v", manifestName, line, err)
+		}
+		f := Frame{
+			Seq:      e.Seq,
+			Time:     time.Unix(0, e.Time),
+			Descr:    e.Descr,
+			Table:    e.Table,
+			HandID:   e.HandID,
+			Phase:    e.Phase,
+			Kind:     e.Kind,
+			Base:     e.Base,
+			Tiles:    e.Tiles,
+			Readings: e.Readings,
+			Labels:   labels[e.Seq],
+		}
+		if e.File != "" {
+			f.Path = dir + filepath.Base(e.File)
+		}
+		if f.Kind == "" {
+			f.Kind = frameKey
+		}
+		frames = append(frames, f)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
 	}
 
-	// Update lastDate so that next time, the next image in the sequence will
-	// be returned instead.
-	is.lastDate = fileInfo.ModTime()
+	sort.SliceStable(frames, func(i, j int) bool {
+		return frames[i].Seq < frames[j].Seq
+	})
 
-	// Get description from file name
-	var descr = ""
-	strSplit := strings.Split(fileInfo.Name(), "_")
-	if len(strSplit) >= 2 {
-		descr = strSplit[1]
+	// Link the frames to those they build on, which come before them.
+	bySeq := make(map[int]*Frame)
+	for i := range frames {
+		f := &frames[i]
+		if f.Kind != frameKey {
+			f.base = bySeq[f.Base]
+		}
+		bySeq[f.Seq] = f
 	}
-	log.Infof("History: %v", descr)
+	return frames, nil
+}
 
-	// Read file
-	file, err := os.Open(is.dir + fileInfo.Name())
+// listModTime returns the frames of a dump without a manifest, whose files
+// are named "<unix-seconds>_<descr>.png", in the order of their modification
+// times.
+func listModTime(dir string) ([]Frame, error) {
+	ls, err := ioutil.ReadDir(dir)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	defer file.Close()
 
-	// Decode image
-	img, err = png.Decode(file)
-	if err != nil {
-		panic(err)
+	var frames []Frame
+	for _, f := range ls {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), ".png") {
+			continue
+		}
+
+		// Get description from file name
+		var descr = ""
+		strSplit := strings.SplitN(strings.TrimSuffix(f.Name(), ".png"), "_", 2)
+		if len(strSplit) >= 2 {
+			descr = strSplit[1]
+		}
+
+		frames = append(frames, Frame{
+			Path:  dir + f.Name(),
+			Time:  f.ModTime(),
+			Descr: descr,
+			Kind:  frameKey,
+		})
 	}
 
-	vision.SetImage(img)
-	return img
+	sort.SliceStable(frames, func(i, j int) bool {
+		return frames[i].Time.Before(frames[j].Time)
+	})
+
+	return frames, nil
 }
 
-// Save saves a historical image.
-func Save(descr string) {
-	// Determine directory and file name
-	pid := fmt.Sprintf("%v", os.Getpid())
-	time := fmt.Sprintf("%v", time.Now().Unix())
-	dir := "./dump/" + pid + "/"
-	file := time + "_" + descr + ".png"
+// dump is the image-dump of this process. Tables save their images from
+// goroutines of their own. The lock guards the sequence numbers, the tracks and
+// the manifest; images are encoded under the lock of their track only, so that
+// the tables do not wait for each other's images.
+var dump struct {
+	mu       sync.Mutex
+	seq      int
+	manifest *os.File
+	tracks   map[string]*track
+}
 
-	// Create dirs
-	os.MkdirAll(dir, os.ModePerm)
+// Save saves a historical image. The sequence number, time, path and kind of
+// the frame are filled in. A frame which fails to save is left out of the
+// dump, and the next frame of its table is a key frame.
+func Save(img image.Image, f Frame) error {
+	dir := dumpDir(os.Getpid())
+	t, err := reserve(&f, dir)
+	if err != nil {
+		return err
+	}
+	defer t.mu.Unlock()
+
+	var out image.Image
+	f.Kind, f.Base, f.Tiles, out = t.encode(toRGBA(img), f.Seq)
+
+	var file string
+	if out != nil {
+		if f.Kind == frameDelta {
+			file = fmt.Sprintf("%06d_%v.delta.png", f.Seq, f.Descr)
+		} else {
+			file = fmt.Sprintf("%06d_%v.png", f.Seq, f.Descr)
+		}
+		f.Path = dir + file
+		if err := writePNG(f.Path, out); err != nil {
+			t.prev = nil
+			return err
+		}
+	}
 
-	// Create and open file
-	f, err := os.Create(dir + file)
+	// The manifest is written last, so it only lists complete images. Key
+	// frames are not marked, like the frames of dumps of older versions.
+	kind := f.Kind
+	if kind == frameKey {
+		kind = ""
+	}
+	line, err := json.Marshal(entry{
+		Seq:      f.Seq,
+		Time:     f.Time.UnixNano(),
+		Descr:    f.Descr,
+		Table:    f.Table,
+		HandID:   f.HandID,
+		Phase:    f.Phase,
+		File:     file,
+		Kind:     kind,
+		Base:     f.Base,
+		Tiles:    f.Tiles,
+		Readings: f.Readings,
+	})
+	if err == nil {
+		dump.mu.Lock()
+		_, err = dump.manifest.Write(append(line, '\n'))
+		dump.mu.Unlock()
+	}
 	if err != nil {
-		panic(err)
+		t.prev = nil
+		return err
 	}
-	defer f.Close()
+	return nil
+}
+
+// reserve fills in the sequence number and time of a frame and returns the
+// track of its table, locked. The track is locked before the dump is unlocked,
+// so the frames of a table are encoded in the order of their numbers.
+func reserve(f *Frame, dir string) (*track, error) {
+	dump.mu.Lock()
+	defer dump.mu.Unlock()
+
+	if dump.manifest == nil {
+		// Create dirs
+		if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+			return nil, err
+		}
 
-	// Encode image
-	err = png.Encode(f, vision.Image())
+		m, err := os.OpenFile(dir+manifestName,
+			os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+		if err != nil {
+			return nil, err
+		}
+		dump.manifest = m
+		dump.tracks = make(map[string]*track)
+	}
+
+	dump.seq++
+	f.Seq = dump.seq
+	f.Time = time.Now()
+
+	t := dump.tracks[f.Table]
+	if t == nil {
+		t = &track{}
+		dump.tracks[f.Table] = t
+	}
+	t.mu.Lock()
+	return t, nil
+}
+
+// writePNG encodes an image into a new file.
+func writePNG(path string, img image.Image) error {
+	out, err := os.Create(path)
 	if err != nil {
-		panic(err)
+		return err
 	}
 
-	f.Sync()
+	if err := png.Encode(out, img); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
 }
@@ -0,0 +1,417 @@
+package history
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/whomever000/poker-client-pokerstars/vision"
+)
+
+// inTempDir runs the test in a temporary directory, where the dumps go, with
+// a dump of its own.
+func inTempDir(t *testing.T) func() {
+	dir, err := ioutil.TempDir("", "history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	return func() {
+		if dump.manifest != nil {
+			dump.manifest.Close()
+		}
+		dump.manifest, dump.seq = nil, 0
+		os.Chdir(wd)
+		os.RemoveAll(dir)
+	}
+}
+
+// TestSaveList verifies that images saved in the same second are listed in
+// the order they were saved, along with what the manifest says about them.
+func TestSaveList(t *testing.T) {
+	defer inTempDir(t)()
+
+	img := image.NewRGBA(image.Rect(0, 0, 2, 2))
+	descrs := []string{"b", "a", "c"}
+	for i, d := range descrs {
+		Save(img, Frame{Descr: d, Table: "Aaltje II", HandID: i + 1,
+			Phase: "flop"})
+	}
+
+	frames, err := List(os.Getpid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(frames) != len(descrs) {
+		t.Fatalf("Expected %v frames, got %v", len(descrs), len(frames))
+	}
+	for i, f := range frames {
+		if f.Seq != i+1 || f.Descr != descrs[i] || f.HandID != i+1 ||
+			f.Table != "Aaltje II" || f.Phase != "flop" {
+			t.Errorf("Unexpected frame %+v", f)
+		}
+		if _, err := f.Image(); err != nil {
+			t.Errorf("Failed to read frame %v: %v", f.Seq, err)
+		}
+	}
+}
+
+// TestListModTime verifies that dumps without a manifest are listed by the
+// modification times of their files.
+func TestListModTime(t *testing.T) {
+	defer inTempDir(t)()
+
+	dir := dumpDir(1)
+	os.MkdirAll(dir, os.ModePerm)
+	now := time.Now()
+	for i, name := range []string{"200_second.png", "100_first.png"} {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, nil, 0666); err != nil {
+			t.Fatal(err)
+		}
+		mod := now.Add(time.Duration(1-i) * time.Second)
+		if err := os.Chtimes(path, mod, mod); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	frames, err := List(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(frames) != 2 || frames[0].Descr != "first" ||
+		frames[1].Descr != "second" {
+		t.Errorf("Unexpected frames %+v", frames)
+	}
+}
+
+// TestSaveDelta verifies that images recorded as deltas and duplicates are
+// decoded exactly as they were saved, in order and one by one.
+func TestSaveDelta(t *testing.T) {
+	defer inTempDir(t)()
+
+	// Opaque images, like screenshots, of two tables which take turns, where
+	// some of them only change in a single tile.
+	base := image.NewRGBA(image.Rect(0, 0, 100, 70))
+	for i := range base.Pix {
+		base.Pix[i] = uint8(i)
+		if i%4 == 3 {
+			base.Pix[i] = 255
+		}
+	}
+	changed := toRGBA(base)
+	changed.Set(40, 40, color.RGBA{1, 2, 3, 255})
+	other := image.NewRGBA(image.Rect(0, 0, 50, 50))
+
+	images := []*image.RGBA{base, other, base, changed, other, changed, base}
+	tables := []string{"a", "b", "a", "a", "b", "a", "a"}
+	kinds := []string{frameKey, frameKey, frameDup, frameDelta, frameDup,
+		frameDup, frameDelta}
+	for i, img := range images {
+		if err := Save(img, Frame{Descr: "x", Table: tables[i]}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	frames, err := List(os.Getpid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(frames) != len(images) {
+		t.Fatalf("Expected %v frames, got %v", len(images), len(frames))
+	}
+
+	var dec Decoder
+	for i, f := range frames {
+		if f.Kind != kinds[i] {
+			t.Errorf("Frame %v: Expected %v, got %v", f.Seq, kinds[i], f.Kind)
+		}
+		img, err := dec.Image(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		single, err := f.Image()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(toRGBA(img).Pix, images[i].Pix) ||
+			!bytes.Equal(toRGBA(single).Pix, images[i].Pix) {
+			t.Errorf("Frame %v differs from the image saved", f.Seq)
+		}
+	}
+}
+
+// TestSaveConcurrent verifies that the frames of tables saving at the same
+// time decode as they were saved.
+func TestSaveConcurrent(t *testing.T) {
+	defer inTempDir(t)()
+
+	// Each table saves images which change in one more pixel each time.
+	const tables, saves = 4, 10
+	saved := make(map[string][]*image.RGBA)
+	for i := 0; i < tables; i++ {
+		img := image.NewRGBA(image.Rect(0, 0, 100, 70))
+		for j := 0; j < saves; j++ {
+			img = toRGBA(img)
+			img.Set(j*10, i*10, color.RGBA{uint8(i), uint8(j), 1, 255})
+			table := fmt.Sprint(i)
+			saved[table] = append(saved[table], img)
+		}
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, tables*saves)
+	for table, images := range saved {
+		wg.Add(1)
+		go func(table string, images []*image.RGBA) {
+			defer wg.Done()
+			for _, img := range images {
+				errs <- Save(img, Frame{Descr: "x", Table: table})
+			}
+		}(table, images)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	frames, err := List(os.Getpid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var dec Decoder
+	next := make(map[string]int)
+	for _, f := range frames {
+		img, err := dec.Image(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := saved[f.Table][next[f.Table]]
+		next[f.Table]++
+		if !bytes.Equal(toRGBA(img).Pix, expected.Pix) {
+			t.Errorf("Frame %v of table %v differs from the image saved",
+				f.Seq, f.Table)
+		}
+	}
+}
+
+// TestSaveKeyInterval verifies that a key frame is saved after keyInterval
+// frames which build on the one before.
+func TestSaveKeyInterval(t *testing.T) {
+	defer inTempDir(t)()
+
+	img := image.NewRGBA(image.Rect(0, 0, 2, 2))
+	for i := 0; i < keyInterval+2; i++ {
+		Save(img, Frame{Descr: "x"})
+	}
+
+	frames, err := List(os.Getpid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, f := range frames {
+		key := i == 0 || i == keyInterval+1
+		if (f.Kind == frameKey) != key {
+			t.Errorf("Frame %v: Unexpected kind %v", f.Seq, f.Kind)
+		}
+	}
+}
+
+// TestParseReplay verifies the replay modes.
+func TestParseReplay(t *testing.T) {
+	tests := []struct {
+		mode string
+		r    Replay
+		err  bool
+	}{
+		{"step", Replay{Step: true}, false},
+		{"fast", Replay{}, false},
+		{"realtime", Replay{Speed: 1}, false},
+		{"10x", Replay{Speed: 10}, false},
+		{"0.5x", Replay{Speed: 0.5}, false},
+		{"10", Replay{}, true},
+		{"0x", Replay{}, true},
+		{"slow", Replay{}, true},
+	}
+
+	for _, test := range tests {
+		r, err := ParseReplay(test.mode)
+		if (err != nil) != test.err || r != test.r {
+			t.Errorf("%q: Expected %+v (error %v), got %+v (%v)", test.mode,
+				test.r, test.err, r, err)
+		}
+	}
+}
+
+// TestSeek verifies that a single table is replayed, and a single hand from
+// the frames of its table waiting for it to start.
+func TestSeek(t *testing.T) {
+	frames := []Frame{
+		{Seq: 1, Table: "a - #1", HandID: 1, Phase: "river"},
+		{Seq: 2, Table: "a - #1", HandID: 1, Phase: "complete"},
+		{Seq: 3, Table: "b - #7", HandID: 7, Phase: "flop"},
+		{Seq: 4, Table: "a - #2", HandID: 1, Phase: "complete"},
+		{Seq: 5, Table: "a - #2", HandID: 2, Phase: "preflop"},
+		{Seq: 6, Table: "b - #7", HandID: 7, Phase: "turn"},
+		{Seq: 7, Table: "a - #2", HandID: 2, Phase: "complete"},
+		{Seq: 8, Table: "a - #3", HandID: 2, Phase: "complete"},
+		{Seq: 9, Table: "a - #3", HandID: 3, Phase: "preflop"},
+	}
+
+	tests := []struct {
+		r   Replay
+		seq []int
+	}{
+		{Replay{Table: "a"}, []int{1, 2, 4, 5, 7, 8, 9}},
+		{Replay{Table: "b"}, []int{3, 6}},
+		{Replay{Seq: 7}, []int{7, 8, 9}},
+		{Replay{Seq: 4, Table: "a"}, []int{4, 5, 7, 8, 9}},
+		{Replay{HandID: 2}, []int{2, 4, 5, 7, 8}},
+		{Replay{HandID: 7}, []int{3, 6}},
+		{Replay{Seq: 4, HandID: 2}, []int{4, 5, 7, 8}},
+	}
+
+	for _, test := range tests {
+		got, err := seek(frames, test.r)
+		if err != nil {
+			t.Errorf("%+v: %v", test.r, err)
+			continue
+		}
+		var seq []int
+		for _, f := range got {
+			seq = append(seq, f.Seq)
+		}
+		if fmt.Sprint(seq) != fmt.Sprint(test.seq) {
+			t.Errorf("%+v: Expected frames %v, got %v", test.r, test.seq, seq)
+		}
+	}
+
+	if _, err := seek(frames, Replay{HandID: 4}); err == nil {
+		t.Error("Expected an error for a missing hand")
+	}
+	if _, err := seek(frames, Replay{Table: "c"}); err == nil {
+		t.Error("Expected an error for a missing table")
+	}
+	if _, err := seek(frames, Replay{}); err == nil {
+		t.Error("Expected an error for the frames of several tables")
+	}
+}
+
+// TestSaveError verifies that a frame which fails to save is reported and
+// left out of the dump, and that the next frame does not build on it.
+func TestSaveError(t *testing.T) {
+	defer inTempDir(t)()
+
+	// A file in the way of the dump directory.
+	if err := ioutil.WriteFile("dump", nil, 0666); err != nil {
+		t.Fatal(err)
+	}
+	base := image.NewRGBA(image.Rect(0, 0, 100, 70))
+	if err := Save(base, Frame{Descr: "x"}); err == nil {
+		t.Error("Expected an error without a dump directory")
+	}
+	os.Remove("dump")
+
+	// A directory in the way of the delta of the second frame.
+	changed := toRGBA(base)
+	changed.Set(40, 40, color.RGBA{1, 2, 3, 255})
+	if err := Save(base, Frame{Descr: "x"}); err != nil {
+		t.Fatal(err)
+	}
+	delta := fmt.Sprintf("%v%06d_x.delta.png", dumpDir(os.Getpid()), dump.seq+1)
+	if err := os.Mkdir(delta, os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	if err := Save(changed, Frame{Descr: "x"}); err == nil {
+		t.Error("Expected an error writing the delta")
+	}
+	if err := Save(changed, Frame{Descr: "x"}); err != nil {
+		t.Fatal(err)
+	}
+
+	frames, err := List(os.Getpid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(frames) != 2 {
+		t.Fatalf("Expected 2 frames, got %v", len(frames))
+	}
+	if f := frames[1]; f.Kind != frameKey {
+		t.Errorf("Frame %v: Expected a key frame after the failed one, got %v",
+			f.Seq, f.Kind)
+	}
+}
+
+// TestImageSourceEnd verifies that a replay reports the end of the dump.
+func TestImageSourceEnd(t *testing.T) {
+	defer inTempDir(t)()
+
+	img := image.NewRGBA(image.Rect(0, 0, 2, 2))
+	Save(img, Frame{Descr: "x"})
+	Save(img, Frame{Descr: "y"})
+
+	src := NewImageSource(os.Getpid(), Replay{})
+	for i := 0; i < 2; i++ {
+		if got, err := src.Get(); err != nil || got == nil {
+			t.Fatalf("Frame %v: Expected an image, got %v", i+1, err)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := src.Get(); err != vision.ErrEndOfStream {
+			t.Errorf("Expected the end of the stream, got %v", err)
+		}
+	}
+}
+
+// TestLabels verifies that the readings of a frame are saved with it and
+// corrected by the labels added later.
+func TestLabels(t *testing.T) {
+	defer inTempDir(t)()
+
+	img := image.NewRGBA(image.Rect(0, 0, 2, 2))
+	Save(img, Frame{Descr: "record", Readings: map[string]string{
+		"pot": "$1.50", "plName0": "a1ice"}})
+
+	err := AddLabels(os.Getpid(), []Label{
+		{Seq: 1, Region: "plName0", Value: "alice"},
+		{Seq: 1, Region: "plBet0", Value: "$0.10"},
+		{Seq: 1, Region: "plBet0", Value: "$0.20"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	frames, err := List(os.Getpid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(frames) != 1 {
+		t.Fatalf("Expected 1 frame, got %v", len(frames))
+	}
+	for region, want := range map[string]string{"pot": "$1.50",
+		"plName0": "alice", "plBet0": "$0.20"} {
+
+		if got, ok := frames[0].Reading(region); !ok || got != want {
+			t.Errorf("%v: Expected %q, got %q", region, want, got)
+		}
+	}
+	if got, ok := frames[0].Reading("plStack0"); ok {
+		t.Errorf("plStack0: Expected no reading, got %q", got)
+	}
+}
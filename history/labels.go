@@ -0,0 +1,86 @@
+package history
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// The readings of recorded frames are corrected in a file next to the
+// manifest, labels.jsonl, which holds a label on each line. The manifest
+// itself is never rewritten.
+
+// labelsName is the name of the labels in the directory of a dump.
+const labelsName = "labels.jsonl"
+
+// Label is the correct reading of a region of a frame.
+type Label struct {
+	Seq    int
+	Region string
+	Value  string
+}
+
+// AddLabels adds labels to the dump of the given process ID. They replace
+// the labels added before for the same regions.
+func AddLabels(pid int, labels []Label) error {
+	f, err := os.OpenFile(dumpDir(pid)+labelsName,
+		os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		return err
+	}
+
+	for _, l := range labels {
+		line, err := json.Marshal(l)
+		if err != nil {
+			f.Close()
+			return err
+		}
+		if _, err := f.Write(append(line, '\n')); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	return f.Close()
+}
+
+// readLabels returns the labels of a dump by sequence number and region.
+func readLabels(dir string) (map[int]map[string]string, error) {
+	ret := make(map[int]map[string]string)
+
+	f, err := os.Open(dir + labelsName)
+	if os.IsNotExist(err) {
+		return ret, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		if len(strings.TrimSpace(scanner.Text())) == 0 {
+			continue
+		}
+		var l Label
+		if err := json.Unmarshal(scanner.Bytes(), &l); err != nil {
+			return nil, fmt.Errorf("%v:%v: %v", labelsName, line, err)
+		}
+		if ret[l.Seq] == nil {
+			ret[l.Seq] = make(map[string]string)
+		}
+		ret[l.Seq][l.Region] = l.Value
+	}
+	return ret, scanner.Err()
+}
+
+// Reading returns the reading of a region of the frame, as corrected by its
+// labels, and whether there is one.
+func (f Frame) Reading(region string) (string, bool) {
+	if v, ok := f.Labels[region]; ok {
+		return v, true
+	}
+	v, ok := f.Readings[region]
+	return v, ok
+}
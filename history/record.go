@@ -0,0 +1,188 @@
+package history
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"os"
+	"sync"
+)
+
+// Most images of a table differ from the one before in a few places, or not
+// at all. Each table is therefore recorded as a key frame, saved whole, which
+// is followed by delta frames holding only the tiles which changed since the
+// frame before. Frames identical to the one before are only listed in the
+// manifest. The frames a frame builds on are those of the same table.
+
+// The kinds of frames.
+const (
+	frameKey   = "key"
+	frameDelta = "delta"
+	frameDup   = "dup"
+)
+
+// tileSize is the width and height of the tiles compared between frames.
+const tileSize = 32
+
+// keyInterval is the most frames of a table between two key frames, which
+// bounds the frames needed to decode any one of them.
+const keyInterval = 100
+
+// track is what is recorded of a table so far.
+type track struct {
+	// mu is held while a frame of the track is encoded.
+	mu      sync.Mutex
+	prev    *image.RGBA
+	prevSeq int
+	// sinceKey is the number of frames since the last key frame.
+	sinceKey int
+}
+
+// tiles returns the number of columns and rows of tiles of an image.
+func tiles(r image.Rectangle) (cols, rows int) {
+	return (r.Dx() + tileSize - 1) / tileSize, (r.Dy() + tileSize - 1) / tileSize
+}
+
+// tileRect returns the rectangle of a tile, by its index in row order.
+func tileRect(r image.Rectangle, tile int) image.Rectangle {
+	cols, _ := tiles(r)
+	min := r.Min.Add(image.Pt(tile%cols*tileSize, tile/cols*tileSize))
+	return image.Rectangle{min, min.Add(image.Pt(tileSize, tileSize))}.Intersect(r)
+}
+
+// toRGBA returns a copy of an image.
+func toRGBA(img image.Image) *image.RGBA {
+	ret := image.NewRGBA(img.Bounds())
+	draw.Draw(ret, ret.Bounds(), img, img.Bounds().Min, draw.Src)
+	return ret
+}
+
+// changedTiles returns the tiles in which two images of the same size differ.
+func changedTiles(a, b *image.RGBA) (ret []int) {
+	cols, rows := tiles(a.Bounds())
+	for tile := 0; tile < cols*rows; tile++ {
+		r := tileRect(a.Bounds(), tile)
+		for y := r.Min.Y; y < r.Max.Y; y++ {
+			i, j := a.PixOffset(r.Min.X, y), b.PixOffset(r.Min.X, y)
+			n := r.Dx() * 4
+			if !bytes.Equal(a.Pix[i:i+n], b.Pix[j:j+n]) {
+				ret = append(ret, tile)
+				break
+			}
+		}
+	}
+	return
+}
+
+// encode works out how to record an image of a table as the frame with the
+// given sequence number. It returns the kind of the frame, the frame it builds
+// on and the changed tiles, and the image to save, if any.
+func (t *track) encode(img *image.RGBA, seq int) (kind string, base int,
+	changed []int, out image.Image) {
+
+	kind, out = frameKey, img
+	if t.prev != nil && t.prev.Bounds() == img.Bounds() &&
+		t.sinceKey < keyInterval {
+
+		changed = changedTiles(t.prev, img)
+		cols, rows := tiles(img.Bounds())
+		switch {
+		case len(changed) == 0:
+			kind, base, out = frameDup, t.prevSeq, nil
+		case len(changed)*2 <= cols*rows:
+			// The tiles which did not change are left black, which takes
+			// next to no room.
+			diff := image.NewRGBA(img.Bounds())
+			draw.Draw(diff, diff.Bounds(), image.NewUniform(color.Black),
+				image.Point{}, draw.Src)
+			for _, tile := range changed {
+				r := tileRect(img.Bounds(), tile)
+				draw.Draw(diff, r, img, r.Min, draw.Src)
+			}
+			kind, base, out = frameDelta, t.prevSeq, diff
+		}
+	}
+
+	if kind == frameKey {
+		changed = nil
+		t.sinceKey = 0
+	} else {
+		t.sinceKey++
+	}
+	if kind != frameDup {
+		t.prev = img
+	}
+	t.prevSeq = seq
+	return
+}
+
+// decoded is the last image a Decoder decoded of a table.
+type decoded struct {
+	seq int
+	img image.Image
+}
+
+// Decoder decodes the frames of an image-dump. Decoding the frames in order
+// only reads the file of each frame once, while Frame.Image decodes all the
+// frames a frame builds on.
+type Decoder struct {
+	last map[string]decoded
+}
+
+// Image decodes the image of a frame.
+func (d *Decoder) Image(f Frame) (image.Image, error) {
+	var img image.Image
+	if f.Kind == frameDup || f.Kind == frameDelta {
+		var base image.Image
+		if l, ok := d.last[f.Table]; ok && l.seq == f.Base {
+			base = l.img
+		} else if f.base != nil {
+			var err error
+			if base, err = f.base.Image(); err != nil {
+				return nil, err
+			}
+		} else {
+			return nil, fmt.Errorf("frame %v builds on frame %v, which is "+
+				"missing", f.Seq, f.Base)
+		}
+
+		img = base
+		if f.Kind == frameDelta {
+			diff, err := decodePNG(f.Path)
+			if err != nil {
+				return nil, err
+			}
+			ret := toRGBA(base)
+			for _, tile := range f.Tiles {
+				r := tileRect(ret.Bounds(), tile)
+				draw.Draw(ret, r, diff, r.Min, draw.Src)
+			}
+			img = ret
+		}
+	} else {
+		var err error
+		if img, err = decodePNG(f.Path); err != nil {
+			return nil, err
+		}
+	}
+
+	if d.last == nil {
+		d.last = make(map[string]decoded)
+	}
+	d.last[f.Table] = decoded{f.Seq, img}
+	return img, nil
+}
+
+// decodePNG reads and decodes a PNG file.
+func decodePNG(path string) (image.Image, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return png.Decode(file)
+}
@@ -0,0 +1,136 @@
+package history
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Replay is how an image source replays an image-dump.
+type Replay struct {
+	// Step waits for a line on standard input before each frame. Otherwise
+	// the frames are replayed at Speed times the pace they were saved at, or
+	// as fast as possible if Speed is 0.
+	Step  bool
+	Speed float64
+	// Seq is the sequence number of the frame to start from. HandID is the
+	// number of a single hand to replay. Both are 0 to replay the whole dump.
+	Seq    int
+	HandID int
+	// Table selects the frames of the table whose name contains it. It may
+	// be empty if the frames replayed are of a single table.
+	Table string
+}
+
+// ParseReplay parses how to replay an image-dump: "step", "fast", "realtime"
+// or a speed, e.g. "10x".
+func ParseReplay(mode string) (Replay, error) {
+	switch mode {
+	case "step":
+		return Replay{Step: true}, nil
+	case "fast":
+		return Replay{}, nil
+	case "realtime":
+		return Replay{Speed: 1}, nil
+	}
+
+	speed, err := strconv.ParseFloat(strings.TrimSuffix(mode, "x"), 64)
+	if err != nil || speed <= 0 || !strings.HasSuffix(mode, "x") {
+		return Replay{}, fmt.Errorf("invalid replay mode %q", mode)
+	}
+	return Replay{Speed: speed}, nil
+}
+
+// reHandNumber matches the number of the current hand in the name of a table
+// window, e.g. "#167000000001".
+var reHandNumber = regexp.MustCompile(`#\d+`)
+
+// TableName returns the name of a table window without the number of the
+// current hand, which changes with every hand. It identifies the table.
+func TableName(window string) string {
+	return strings.Join(strings.Fields(reHandNumber.ReplaceAllString(window,
+		"")), " ")
+}
+
+// completePhase is the phase of the frames saved between hands.
+const completePhase = "complete"
+
+// seek returns the frames to replay, which are of a single table. A single
+// hand is replayed from the frames of its table waiting for it to start,
+// which are saved with the phase "complete", to its last frame.
+func seek(frames []Frame, r Replay) ([]Frame, error) {
+	start := 0
+	for start < len(frames) && frames[start].Seq < r.Seq {
+		start++
+	}
+	frames = frames[start:]
+
+	if r.Table != "" {
+		var selected []Frame
+		for _, f := range frames {
+			if strings.Contains(f.Table, r.Table) {
+				selected = append(selected, f)
+			}
+		}
+		if len(selected) == 0 {
+			return nil, fmt.Errorf("table %q is not in the dump", r.Table)
+		}
+		frames = selected
+	}
+
+	if r.HandID == 0 {
+		if tables := tableNames(frames); len(tables) > 1 {
+			return nil, fmt.Errorf("the dump has frames of %v tables, "+
+				"select one of %q", len(tables), tables)
+		}
+		return frames, nil
+	}
+
+	first, last := -1, -1
+	for i, f := range frames {
+		if f.HandID == r.HandID {
+			if first < 0 {
+				first = i
+			}
+			last = i
+		}
+	}
+	if first < 0 {
+		return nil, fmt.Errorf("hand %v is not in the dump", r.HandID)
+	}
+
+	var ret []Frame
+	table := TableName(frames[first].Table)
+	for i := first - 1; i >= 0; i-- {
+		f := frames[i]
+		if TableName(f.Table) != table {
+			continue
+		}
+		if f.Phase != completePhase {
+			break
+		}
+		ret = append([]Frame{f}, ret...)
+	}
+	for _, f := range frames[first : last+1] {
+		if TableName(f.Table) == table {
+			ret = append(ret, f)
+		}
+	}
+	return ret, nil
+}
+
+// tableNames returns the names of the tables of the frames, sorted.
+func tableNames(frames []Frame) []string {
+	seen := make(map[string]bool)
+	var ret []string
+	for _, f := range frames {
+		if name := TableName(f.Table); !seen[name] {
+			seen[name] = true
+			ret = append(ret, name)
+		}
+	}
+	sort.Strings(ret)
+	return ret
+}
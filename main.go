@@ -15,22 +15,23 @@ import (
 	"flag"
 
 	"os"
+	"sort"
 
+	"github.com/whomever000/poker-client-pokerstars/handhistory"
 	"github.com/whomever000/poker-client-pokerstars/history"
 	"github.com/whomever000/poker-client-pokerstars/vision"
 	"github.com/whomever000/poker-common"
 	"github.com/whomever000/poker-common/card"
 	"github.com/whomever000/poker-common/window"
-	"github.com/whomever000/poker-vision"
 )
 
-var (
-	img    image.Image
-	h      *poker.Hand
-	imgSrc vision.ImageSource
+var usingHistory bool
 
-	usingHistory bool
-)
+// heroName is our screen name, or empty to find our seat by our cards.
+var heroName string
+
+// rakeSchedule is the rake the site takes, or nil if it could not be loaded.
+var rakeSchedule *handhistory.RakeSchedule
 
 func init() {
 
@@ -38,140 +39,456 @@ func init() {
 
 	// Set custom file loader.
 	// This loads files from static data which is compiled into the application.
-	pokervision.SetFileLoader(&fileLoader{})
+	loader := &fileLoader{}
+	vision.SetFileLoader(loader)
 
 	// Load reference file.
 	if err := vision.LoadReferences(); err != nil {
 		log.Panic("failed to load references", err)
 	}
+
+	// Load rake schedule.
+	var err error
+	rakeSchedule, err = handhistory.ReadRakeSchedule(
+		loader.Load("./references/rake.json"))
+	if err != nil {
+		log.Warnf("failed to load rake schedule. %v", err)
+	}
 }
 
-// Attach attaches to a window by the specified name.
-func Attach(windowName string) error {
+// Attach attaches to a window by the specified name and creates the session of
+// its table. The images are taken from imgSrc, or from the window if nil. A
+// history is replayed without a window, from the images in imgSrc.
+func Attach(windowName string, imgSrc vision.ImageSource,
+	out *sink) (*session, error) {
 
 	// Find and attach to window.
-	win, err := window.Attach(windowName)
-	if err != nil {
-		log.Errorf("failed to attach to window '%v'. %v", windowName, err)
-		return err
+	var win window.Window
+	if !usingHistory {
+		var err error
+		win, err = window.Attach(windowName)
+		if err != nil {
+			log.Errorf("failed to attach to window '%v'. %v", windowName, err)
+			return nil, err
+		}
+		if imgSrc == nil {
+			imgSrc = vision.NewWindowImageSource(win)
+		}
 	}
 
 	// Get window name.
-	name, err := win.Name()
+	name, err := windowNameOf(win, imgSrc)
 	if err != nil {
 		log.Warnf("failed to get window name. %v", err)
 	}
+	s := newSession(win, name, imgSrc, out)
+
+	s.getImage("attach")
+	if s.img() == nil {
+		err := fmt.Errorf("no image of the table")
+		s.log.Errorf("failed to attach to the table. %v", err)
+		return nil, err
+	}
+
+	// Select the layout of the table size, from the window name or else
+	// from what the table looks like.
+	size := vision.SeatsFromName(name)
+	if size == 0 {
+		if size, err = vision.DetectSeats(s.img()); err != nil {
+			s.log.Errorf("failed to detect the table size. %v", err)
+			return nil, err
+		}
+	}
+	if err := s.view.SetLayout(size); err != nil {
+		// Detect the size of a table without a layout for the size in its
+		// name, rather than refusing it.
+		s.log.Warnf("failed to select table layout. %v", err)
+		if size, err = vision.DetectSeats(s.img()); err != nil {
+			s.log.Errorf("failed to detect the table size. %v", err)
+			return nil, err
+		}
+		if err := s.view.SetLayout(size); err != nil {
+			s.log.Errorf("failed to select table layout. %v", err)
+			return nil, err
+		}
+	}
+	// A window which does not show a table, or is of another aspect ratio,
+	// cannot be read.
+	if err := s.view.Check(s.img()); err != nil {
+		s.log.Errorf("failed to read the table. %v", err)
+		return nil, err
+	}
+
 	strs := strings.Split(name, " - ")
 	if len(strs) < 3 {
-		log.Warnf("window name has an unexpected format. %v. %v", name, err)
+		s.log.Warnf("window name has an unexpected format. %v. %v", name, err)
 	} else {
 		name = strs[0]
 	}
 
-	// Get process name.
-	process, err := win.Process()
-	if err != nil {
-		log.Warnf("failed to get process name. %v", err)
+	s.log.Infof("PID: %v", os.Getpid())
+	if usingHistory {
+		s.log.Infof("replaying table '%v'", name)
+	} else {
+		// Get process name.
+		process, err := win.Process()
+		if err != nil {
+			s.log.Warnf("failed to get process name. %v", err)
+		}
+		s.log.Infof("attached to window '%v' of process '%v'", name, process)
 	}
-
-	log.Infof("PID: %v", os.Getpid())
-	log.Infof("attached to window '%v' of process '%v'", name, process)
-	return nil
+	s.log.Infof("%v-max table", s.view.Seats())
+	return s, nil
 }
 
 ////////////////////////////////////////////////////////////////////////////////
-var (
-	better        poker.PlayerPosition
-	activePlayers []poker.PlayerPosition
-	playerStacks  [6]poker.Amount
+
+const (
+	// pollInterval is the time between two images while waiting (ms).
+	pollInterval = 500
+	// cardsTimeout is the longest time to wait for community cards (ms).
+	cardsTimeout = 30000
+	// actionTimeout is the longest time to wait for a player to act (ms).
+	// This includes the time bank.
+	actionTimeout = 90000
+	// showdownTimeout is the longest time to wait for the pot to be pushed
+	// to the winners (ms).
+	showdownTimeout = 15000
+	// maxRereads is the number of new images taken when a reading is
+	// uncertain, before it is marked as uncertain in the hand.
+	maxRereads = 3
+	// frameInterval is the time between the images of a region which is
+	// read until it is stable (ms).
+	frameInterval = 100
 )
 
+// phase is a state of the hand state machine.
+type phase int
+
+const (
+	phasePreflop phase = iota
+	phaseFlop
+	phaseTurn
+	phaseRiver
+	phaseShowdown
+	phaseComplete
+)
+
+func (p phase) String() string {
+	switch p {
+	case phasePreflop:
+		return "preflop"
+	case phaseFlop:
+		return "flop"
+	case phaseTurn:
+		return "turn"
+	case phaseRiver:
+		return "river"
+	case phaseShowdown:
+		return "showdown"
+	case phaseComplete:
+		return "complete"
+	}
+	return fmt.Sprintf("phase(%d)", int(p))
+}
+
+// commands are the commands which can be run instead of the client, by
+// passing their name as the first argument.
+var commands = map[string]func(args []string) error{
+	"accuracy":  accuracy,
+	"calibrate": calibrate,
+	"extract":   extract,
+	"label":     label,
+	"record":    record,
+}
+
 func main() {
 
+	if len(os.Args) > 1 {
+		if cmd, ok := commands[os.Args[1]]; ok {
+			if err := cmd(os.Args[2:]); err != nil {
+				log.Fatal(err)
+			}
+			return
+		}
+	}
+
 	hFlag := flag.Int("h", 0, "pid of history")
+	replayFlag := flag.String("replay", "step", "how to replay the history: "+
+		"step (on Enter), fast, realtime or a speed, e.g. 10x")
+	seqFlag := flag.Int("seq", 0, "frame of the history to start from")
+	handFlag := flag.Int("hand", 0, "number of a single hand of the history "+
+		"to replay")
+	tableFlag := flag.String("table", "", "table of the history to replay, "+
+		"by part of its window name (default: the only one)")
+	hhFlag := flag.String("hh", "./hands/", "hand-history output directory")
+	cFlag := flag.Float64("c", 0.2, "confidence below which readings are uncertain")
+	wFlag := flag.String("w", "Play Money", "name of the table windows to follow")
+	flag.StringVar(&heroName, "n", "", "our screen name, to find our seat "+
+		"by (default: the seat with face-up cards)")
+	consFlag := flag.String("cons", "", "images per region until a reading is "+
+		"stable, e.g. pot=5/3 reads the pot from up to 5 images until 3 agree")
 	flag.Parse()
+	vision.SetThreshold(vision.Confidence(*cFlag))
+	if err := vision.ParseConsensus(*consFlag); err != nil {
+		log.Fatal(err)
+	}
+
+	exporter := handhistory.NewExporter(*hhFlag)
+	defer exporter.Close()
+	out := &sink{exporter: exporter}
+
+	// A history is replayed one table at a time.
 	if *hFlag != 0 {
+		replay, err := history.ParseReplay(*replayFlag)
+		if err != nil {
+			log.Fatal(err)
+		}
+		replay.Seq, replay.HandID = *seqFlag, *handFlag
+		replay.Table = *tableFlag
+
 		usingHistory = true
-		imgSrc = history.NewImageSource(*hFlag, true)
-	} else {
-		imgSrc = vision.NewDefaultImageSource()
+		s, err := Attach(*wFlag, history.NewImageSource(*hFlag, replay), out)
+		if err != nil {
+			return
+		}
+		s.run()
+		log.Infof("end of history: %v", out.summary())
+		return
 	}
 
-	var currPlayer poker.PlayerPosition
+	// Follow all table windows.
+	watchTables(*wFlag, out, (*session).run)
+}
 
-	// Attach to table window.
-	err := Attach("Play Money")
-	if err != nil {
-		return
+// playHand runs the hand state machine from preflop until the hand is
+// complete.
+func (s *session) playHand() {
+	for s.phase = phasePreflop; s.phase != phaseComplete; {
+		s.log.Infof("phase: %v", s.phase)
+		s.phase = s.nextPhase(s.phase)
 	}
+	s.results()
+	s.log.Info("hand complete")
+}
 
-	// Handle hands.
-	for {
+// nextPhase handles a single phase of the hand and returns the phase that
+// follows it.
+func (s *session) nextPhase(p phase) phase {
 
-		// Wait for new hand.
-		// Wait for pocket cards to be delt.
-		NewHand()
+	switch p {
+	case phasePreflop, phaseFlop, phaseTurn, phaseRiver:
 
-		performFold()
-		continue
+		// Wait for new betting round.
+		// Wait for community cards to be delt.
+		if s.NewBettingRound(int(p)) == "" {
+			s.log.Warnf("missed the %v, ending hand", p)
+			return phaseComplete
+		}
 
-		// Prepare for new hand.
-		currPlayer = nextActivePlayer(h.BigBlind)
-		better = currPlayer
+		// Everyone but one player folded?
+		if s.contenders() < 2 {
+			return phaseComplete
+		}
 
-		// Handle betting rounds.
-		for bettingRound := 0; bettingRound < 4; bettingRound++ {
+		// Nobody left to bet against? (i.e. all-in)
+		if len(s.activePlayers) > 1 {
+			if !s.bettingRound(p) {
+				s.log.Warnf("lost track of the %v, ending hand", p)
+				return phaseComplete
+			}
+		}
 
-			// Wait for new betting round.
-			// Wait for community cards to be delt.
-			NewBettingRound(bettingRound)
+		if s.contenders() < 2 {
+			return phaseComplete
+		}
+		if p == phaseRiver {
+			return phaseShowdown
+		}
+		return p + 1
 
-			// More than 1 player still active?
-			if len(vision.ActivePlayers(img)) > 1 {
+	case phaseShowdown:
+		s.showdown()
+		return phaseComplete
+	}
 
-			bettingRoundLoop:
-				for {
+	return phaseComplete
+}
 
-					// Wait for player action.
-					NewPlayerAction(currPlayer)
+// showdown records the hole cards shown at showdown. Players who do not show
+// their cards mucked them.
+func (s *session) showdown() {
+	contenders := s.contenderPositions()
+
+	// The cards are turned over one after another, then the pot is pushed
+	// to the winners.
+	shown := make(map[poker.PlayerPosition][]card.Card)
+	ok := s.waitImage(func() bool {
+		for _, pos := range contenders {
+			cards, c, err := s.view.ShownCards(s.img(), pos)
+			if err == nil && len(cards) == 2 && !c.Uncertain() {
+				shown[pos] = cards
+			}
+		}
+		return len(shown) == len(contenders) || s.potPushed(contenders)
+	}, pollInterval, showdownTimeout, "waitForShowdown")
+	if !ok {
+		s.log.Warn("missed the cards shown at showdown")
+	}
 
-					// Consider next player.
-					next := poker.NextPlayerPosition(currPlayer, 6)
+	for _, pos := range contenders {
+		if cards, ok := shown[pos]; ok {
+			s.h.Shown = append(s.h.Shown,
+				poker.PlayerCards{Position: pos, Cards: cards})
+			continue
+		}
+		mucked := poker.PlayerCards{Position: pos}
+		if s.h.ThisPlayer != nil && s.h.ThisPlayer.Position == pos {
+			mucked.Cards = s.h.ThisPlayer.Cards
+		}
+		s.h.Mucked = append(s.h.Mucked, mucked)
+	}
+}
 
-					// Consider next active player.
-					currPlayer = nextActivePlayer(currPlayer)
+// results waits for the pot to be pushed to the winners, then works out the
+// pots and what each player collected from how much their stacks grew.
+func (s *session) results() {
+	contenders := s.contenderPositions()
+	if !s.waitImage(func() bool {
+		return s.potPushed(contenders)
+	}, pollInterval, showdownTimeout, "waitForPot") {
+		s.log.Warn("missed the winners of the hand")
+		s.markUncertain("Collected")
+		return
+	}
 
-					// Check if betting round is done.
-					// Next active player is the better? (i.e. end of round)
-					if currPlayer == better {
-						break
-					}
-					// A player between current and next active player is the
-					// better? (i.e. end of round).
-					for next != currPlayer {
-						if next == better {
-							break bettingRoundLoop
-						}
+	certain := true
+	for _, pos := range contenders {
+		r := s.stable("plStack", func(img image.Image) (interface{}, vision.Confidence, error) {
+			return s.view.PlayerStack(img, pos)
+		})
+		// A player who lost all their chips has no stack to read.
+		stack, ok := r.Value.(poker.Amount)
+		if r.Err != nil || !ok || stack < 0 {
+			continue
+		}
+		if r.Confidence.Uncertain() {
+			certain = false
+		}
+		s.playerStacks[pos-1] = stack
+	}
 
-						next = poker.NextPlayerPosition(next, 6)
-					}
-				}
+	if err := handhistory.Resolve(s.h, s.playerStacks); err != nil {
+		s.log.Warnf("failed to work out the result of the hand. %v", err)
+		certain = false
+	} else if rakeSchedule != nil {
+		if err := rakeSchedule.Check(s.h); err != nil {
+			s.log.Warnf("unexpected rake. %v", err)
+			s.markUncertain("Rake")
+		}
+	}
+	if !certain {
+		s.markUncertain("Collected")
+	}
+	for _, c := range s.h.Collected {
+		s.log.Infof("player %v collected %v", c.Position, c.Amount)
+	}
+}
+
+// contenderPositions returns the players who have not folded, in the order
+// of their seats.
+func (s *session) contenderPositions() []poker.PlayerPosition {
+	var contenders []poker.PlayerPosition
+	contenders = append(contenders, s.activePlayers...)
+	contenders = append(contenders, s.allInPlayers...)
+	sort.Slice(contenders, func(i, j int) bool {
+		return contenders[i] < contenders[j]
+	})
+	return contenders
+}
+
+// potPushed returns whether the stack of one of the players grew in the
+// current image, i.e. the pot was pushed to them.
+func (s *session) potPushed(players []poker.PlayerPosition) bool {
+	for _, pos := range players {
+		stack, c, err := s.view.PlayerStack(s.img(), pos)
+		if err == nil && !c.Uncertain() && stack > s.playerStacks[pos-1] {
+			return true
+		}
+	}
+	return false
+}
+
+// bettingRound follows the player actions of a betting round. It returns
+// false if an action could not be observed.
+func (s *session) bettingRound(p phase) bool {
 
-				currPlayer = nextActivePlayer(h.Button)
-				better = currPlayer
+	// The first player to act is the one after the big blind, or after the
+	// last straddle, preflop and the one after the button on later streets.
+	currPlayer := s.nextActivePlayer(s.h.Button)
+	if p == phasePreflop {
+		currPlayer = s.nextActivePlayer(s.lastBlind())
+	}
+	s.better = currPlayer
 
-			} else {
-				fmt.Println("Only 1 left")
+	for {
+
+		// Wait for player action.
+		if s.NewPlayerAction(currPlayer) == "" {
+			return false
+		}
+
+		// Betting is over when everyone but one player folded or when
+		// everyone is all-in.
+		if s.contenders() < 2 || len(s.activePlayers) == 0 {
+			return true
+		}
+
+		// Consider next player.
+		next := poker.NextPlayerPosition(currPlayer, s.view.Seats())
+
+		// Consider next active player.
+		currPlayer = s.nextActivePlayer(currPlayer)
+
+		// Check if betting round is done.
+		// Next active player is the better? (i.e. end of round)
+		if currPlayer == s.better {
+			return true
+		}
+		// A player between current and next active player is the
+		// better? (i.e. end of round).
+		for next != currPlayer {
+			if next == s.better {
+				return true
 			}
+
+			next = poker.NextPlayerPosition(next, s.view.Seats())
+		}
+	}
+}
+
+// lastBlind returns the player who posted the last live blind, the big blind
+// or, if it was straddled, the highest straddle.
+func (s *session) lastBlind() poker.PlayerPosition {
+	last, highest := s.h.BigBlind, poker.Amount(0)
+	for _, a := range s.posted {
+		post, ok := a.Action.(handhistory.PostAction)
+		if ok && post.Post == handhistory.PostStraddle && post.Amount > highest {
+			last, highest = a.Position, post.Amount
 		}
-		fmt.Println(h)
 	}
+	return last
+}
+
+// contenders returns the number of players who have not folded.
+func (s *session) contenders() int {
+	return len(s.activePlayers) + len(s.allInPlayers)
 }
 
-func returnHand() string {
-	b, err := json.MarshalIndent(h, "", "	")
+func (s *session) returnHand() string {
+	b, err := json.MarshalIndent(s.h, "", "	")
 	if err != nil {
-		log.Printf("error: Failed to encode JSON. %v", err)
+		s.log.Printf("error: Failed to encode JSON. %v", err)
 		return ""
 	}
 
@@ -180,37 +497,48 @@ func returnHand() string {
 
 // NewHand waits for a new hand to start, then returns the initial hand JSON
 // structure.
-func NewHand() string {
+func (s *session) NewHand() string {
 
-	log.Info("waiting for new hand")
-	waitForNewHand()
-	log.Info("New hand")
+	s.log.Info("waiting for new hand")
+	if !s.waitForNewHand() {
+		return ""
+	}
+	s.log.Info("New hand")
 
 	// Create new hand object and populate with initial meta-data.
-	h = new(poker.Hand)
-	h.Client = client()
-	h.Table = table()
-	h.HandID = handID()
-	h.Date = date()
-	h.Button = button()
-	h.SmallBlind = smallBlind()
-	h.BigBlind = bigBlind()
-	h.ThisPlayer = thisPlayer()
-	h.Players = players()
+	s.h = new(handhistory.Hand)
+	s.h.Client = client()
+	s.h.Table = s.table()
+	s.hands++
+	s.h.ID = s.hands
+	s.h.HandID = s.handID()
+	s.h.Date = date()
+	s.h.Button = s.button()
+	s.h.Players = s.players()
+	s.h.ThisPlayer = s.thisPlayer()
+	s.posted = s.posts()
+
+	// The stacks are read after the blinds were posted. Hand histories list
+	// the stacks from before.
+	for _, a := range s.posted {
+		post := a.Action.(handhistory.PostAction)
+		s.h.Players[a.Position-1].Stack += post.Amount
+	}
 
 	// Return JSON encoded hand.
-	return returnHand()
+	return s.returnHand()
 }
 
 // NewBettingRound waits for community cards to be delt, then returns the hand
 // JSON structure with added betting round information.
-func NewBettingRound(bettingRound int) string {
+func (s *session) NewBettingRound(bettingRound int) string {
 
-	log.Println("Waiting for new betting round")
+	s.log.Println("Waiting for new betting round")
 
 	var (
 		numExCC   int
 		commCards []card.Card
+		boards    [][]card.Card
 		round     poker.Round
 	)
 
@@ -225,22 +553,50 @@ func NewBettingRound(bettingRound int) string {
 	case 3:
 		numExCC = 5
 	case 4:
-		log.Panicf("unexpected betting round %v, expected 0,1,2 or 3",
+		s.log.Panicf("unexpected betting round %v, expected 0,1,2 or 3",
 			bettingRound)
 	}
 
 	// Wait for the expected number of community cards to be delt.
-	waitImage(func() bool {
-		commCards, _ = vision.CommunityCards(img)
-		log.Debug(commCards)
+	// A hand which is run twice may show all its streets at once, those are
+	// taken from the first board one by one.
+	ok := s.waitImage(func() bool {
+		var c vision.Confidence
+		boards, c, _ = s.view.CommunityBoards(s.img())
+		s.log.Debug(boards)
+		if len(boards) == 0 || c.Uncertain() {
+			return false
+		}
+		commCards = boards[0]
+		if len(boards) == 2 && len(commCards) > numExCC {
+			commCards = commCards[:numExCC]
+		}
 		if numExCC == len(commCards) {
 			return true
 		}
 		return false
-	}, 500, "waitForCommCards")
+	}, pollInterval, cardsTimeout, "waitForCommCards")
+	if !ok {
+		return ""
+	}
+	if len(boards) == 2 {
+		s.log.Infof("hand is run twice: %v", boards)
+		s.h.Boards = boards
+	}
 
 	// Parse pot size.
-	pot, err := vision.Pot(img)
+	var pot poker.Amount
+	var err error
+	if !s.reread(func() vision.Confidence {
+		r := s.stable("pot", func(img image.Image) (interface{}, vision.Confidence, error) {
+			return s.view.Pot(img)
+		})
+		pot, _ = r.Value.(poker.Amount)
+		err = r.Err
+		return r.Confidence
+	}, "rereadPot") {
+		s.markUncertain("Rounds[%d].Pot", len(s.h.Rounds))
+	}
 	if err != nil {
 
 		// TODO: comment out
@@ -248,120 +604,210 @@ func NewBettingRound(bettingRound int) string {
 		//return ""
 	}
 
+	// The bets are collected into the pot between the betting rounds. The
+	// forced bets are the first bets, see posts.
+	if bettingRound == 0 {
+		round.Actions = s.posted
+	} else {
+		s.playerBets = make([]poker.Amount, len(s.playerStacks))
+	}
+
 	// Initialize round object.
 	round.Cards = commCards
 	round.Pot = pot
 
 	// Add it to hand.
-	h.Rounds = append(h.Rounds, round)
+	s.h.Rounds = append(s.h.Rounds, round)
 
-	log.Println("New betting round")
+	s.log.Println("New betting round")
 
 	// Return JSON encoded hand.
-	return returnHand()
+	return s.returnHand()
+}
+
+// betAmount returns the amount a player put in with their last action, from
+// how much their bet grew. Without a reading of the bet, it is the amount the
+// stack shrank by (delta). It returns false if the two disagree.
+func (s *session) betAmount(pos poker.PlayerPosition,
+	delta poker.Amount) (poker.Amount, bool) {
+
+	r := s.stable("plBet", func(img image.Image) (interface{}, vision.Confidence, error) {
+		return s.view.PlayerBet(img, pos)
+	})
+	bet, _ := r.Value.(poker.Amount)
+	if r.Err != nil || r.Confidence.Uncertain() || bet <= s.playerBets[pos-1] {
+		s.playerBets[pos-1] += delta
+		return delta, true
+	}
+
+	amount := bet - s.playerBets[pos-1]
+	s.playerBets[pos-1] = bet
+	if amount != delta {
+		s.log.Warnf("player %v bet %v, but their stack shrank by %v", pos,
+			amount, delta)
+		return amount, false
+	}
+	return amount, true
 }
 
 // NewPlayerAction waits for the player to perform an action, then returns the
 // hand JSON structure with added action information.
-func NewPlayerAction(pos poker.PlayerPosition) string {
+func (s *session) NewPlayerAction(pos poker.PlayerPosition) string {
 
 	var (
 		action      poker.PlayerAction
 		innerAction poker.Action
 	)
 
-	fmt.Print("Player ", pos, ": ")
-
 	var curr poker.PlayerPosition
 
-	waitImage(func() bool {
-		curr = vision.CurrentPlayer(img)
+	ok := s.waitImage(func() bool {
+		// An image which cannot be read is waited past.
+		var err error
+		if curr, err = s.view.CurrentPlayer(s.img()); err != nil {
+			return false
+		}
 		if curr != pos {
 			return true
 		}
 		return false
-	}, 500, "waitForAction")
+	}, pollInterval, actionTimeout, "waitForAction")
+	if !ok {
+		s.log.Warnf("timed out waiting for the action of player %v (%v)",
+			pos, s.phase)
+		return ""
+	}
+
+	// The field of the action, in case it is uncertain.
+	currRound := len(s.h.Rounds)
+	field := fmt.Sprintf("Rounds[%d].Actions[%d]", currRound-1,
+		len(s.h.Rounds[currRound-1].Actions))
 
 	// Get player's action.
-	a, err := vision.PlayerAction(img, pos)
+	var a string
+	var err error
+	certain := s.reread(func() vision.Confidence {
+		r := s.stable("plAction", func(img image.Image) (interface{}, vision.Confidence, error) {
+			return s.view.PlayerAction(img, pos)
+		})
+		a, _ = r.Value.(string)
+		err = r.Err
+		return r.Confidence
+	}, "rereadAction")
 	if err != nil {
 		// TODO: uncomment
 		//log.Printf("error: Failed to get player action. %v", err)
 		return ""
 	}
 
+	// The action label may already have faded. A player without cards has
+	// folded, anything else cannot be recovered.
+	if a == "" {
+		active, err := s.view.ActivePlayers(s.img())
+		if err != nil || hasPosition(active, pos) {
+			s.log.Warnf("missed the action of player %v (%v)", pos, s.phase)
+			return ""
+		}
+		a = "actionFold"
+		certain = true
+	}
+
 	// Get the players stack size.
-	newStack, err := vision.PlayerStack(img, pos)
+	var newStack poker.Amount
+	if !s.reread(func() vision.Confidence {
+		r := s.stable("plStack", func(img image.Image) (interface{}, vision.Confidence, error) {
+			return s.view.PlayerStack(img, pos)
+		})
+		newStack, _ = r.Value.(poker.Amount)
+		err = r.Err
+		return r.Confidence
+	}, "rereadStack") {
+		certain = false
+	}
 	if err != nil {
 		fmt.Printf("error: Failed to parse player stack. %v", err)
 	}
-	// Calculate amount that was called/betted/raised.
-	amount := playerStacks[pos-1] - newStack
+
+	// All in is represented as -1, i.e. the whole stack went in.
+	allIn := newStack == -1
+	if allIn {
+		newStack = 0
+	}
+
+	// Calculate amount that was called/betted/raised. The bet in front of
+	// the player is read first, the stack is a check of it.
+	amount := s.playerStacks[pos-1] - newStack
+	if a != "actionFold" && a != "actionCheck" {
+		var ok bool
+		if amount, ok = s.betAmount(pos, amount); !ok {
+			certain = false
+		}
+	}
+	if !certain {
+		s.markUncertain("%v", field)
+	}
 	// Update player stack reference.
-	playerStacks[pos-1] = newStack
+	s.playerStacks[pos-1] = newStack
 
 	// Create action object
 	switch a {
 	case "actionFold":
 		innerAction = poker.NewFoldAction()
-		for i, p := range activePlayers {
-			if p == pos {
-				activePlayers = append(activePlayers[:i], activePlayers[i+1:]...)
-				break
-			}
-		}
+		s.activePlayers = removePosition(s.activePlayers, pos)
 	case "actionCheck":
 		innerAction = poker.NewCheckAction()
 	case "actionCall":
 		innerAction = poker.NewCallAction(amount)
 	case "actionBet":
 		innerAction = poker.NewBetAction(amount)
-		better = pos
+		s.better = pos
 	case "actionRaise":
 		innerAction = poker.NewRaiseAction(amount)
-		better = pos
-
-		if amount == -1 {
-			for i, p := range activePlayers {
-				if p == pos {
-					activePlayers = append(activePlayers[:i], activePlayers[i+1:]...)
-					break
-				}
-			}
-		}
+		s.better = pos
 	default:
-		log.Printf("error: Invalid player action: %v", a)
-		// TODO: uncomment
-		//panic("")
+		s.log.Printf("error: Invalid player action: %v", a)
+		return ""
+	}
+
+	// A player who is all-in takes no further part in the betting.
+	if allIn && a != "actionFold" {
+		s.activePlayers = removePosition(s.activePlayers, pos)
+		s.allInPlayers = append(s.allInPlayers, pos)
 	}
 
 	// Initialize PlayerAction object
 	action.Position = pos
 	action.Action = innerAction
 
-	fmt.Println(innerAction, "\tStack:", playerStacks[pos-1])
+	fmt.Printf("Player %v: %v\tStack: %v\n", pos, innerAction,
+		s.playerStacks[pos-1])
 
 	// Insert into last round.
-	currRound := len(h.Rounds)
-	h.Rounds[currRound-1].Actions = append(h.Rounds[currRound-1].Actions, action)
+	s.h.Rounds[currRound-1].Actions = append(s.h.Rounds[currRound-1].Actions, action)
 
 	// Return JSON encoded hand.
-	return returnHand()
+	return s.returnHand()
 }
 
-// waitForNewHand waits for a new hand.
-func waitForNewHand() {
+// waitForNewHand waits for a new hand. It returns false if the table was
+// closed.
+func (s *session) waitForNewHand() bool {
 
 	numActive := 0
-	lowestNum := 6
+	lowestNum := s.view.Seats()
 
-	waitImage(func() bool {
+	return s.waitImage(func() bool {
 
-		// Has number of active players decreased?
-		numActive = len(vision.ActivePlayers(img))
+		// Has number of active players decreased? An image which cannot
+		// be read is waited past.
+		active, err := s.view.ActivePlayers(s.img())
+		if err != nil {
+			return false
+		}
+		numActive = len(active)
 		if numActive < lowestNum {
 			lowestNum = numActive
-			history.Save("newLow")
+			s.save("newLow")
 
 			// Has number of active players increased?
 		} else if numActive > lowestNum {
@@ -371,24 +817,28 @@ func waitForNewHand() {
 			// Wait for table to be cleared.
 			// Wait for all players to become active.
 			// This does not happen at the exact same time.
-			sleep(4000)
-			getImage("waitForCardsDealt")
-			activePlayers = vision.ActivePlayers(img)
+			s.sleep(4000)
+			s.getImage("waitForCardsDealt")
+			if s.activePlayers, err = s.view.ActivePlayers(s.img()); err != nil {
+				s.log.Warnf("failed to read the active players. %v", err)
+				return false
+			}
+			s.allInPlayers = nil
 			return true
 		}
 
 		return false
 
-	}, 500, "waitForNewHand")
+	}, pollInterval, 0, "waitForNewHand")
 }
 
-func nextActivePlayer(pos poker.PlayerPosition) poker.PlayerPosition {
+func (s *session) nextActivePlayer(pos poker.PlayerPosition) poker.PlayerPosition {
 
-	for i := 0; i < 6; i++ {
-		pos = poker.NextPlayerPosition(pos, 6)
+	for i := 0; i < s.view.Seats(); i++ {
+		pos = poker.NextPlayerPosition(pos, s.view.Seats())
 
-		for a := 0; a < len(activePlayers); a++ {
-			if activePlayers[a] == pos {
+		for a := 0; a < len(s.activePlayers); a++ {
+			if s.activePlayers[a] == pos {
 				return pos
 			}
 		}
@@ -397,26 +847,152 @@ func nextActivePlayer(pos poker.PlayerPosition) poker.PlayerPosition {
 	return 0
 }
 
+// hasPosition returns true if pos is in the list of positions.
+func hasPosition(list []poker.PlayerPosition, pos poker.PlayerPosition) bool {
+	for _, p := range list {
+		if p == pos {
+			return true
+		}
+	}
+	return false
+}
+
+// removePosition removes pos from the list of positions.
+func removePosition(list []poker.PlayerPosition,
+	pos poker.PlayerPosition) []poker.PlayerPosition {
+
+	for i, p := range list {
+		if p == pos {
+			return append(list[:i], list[i+1:]...)
+		}
+	}
+	return list
+}
+
 // Get a new image
-func getImage(descr string) {
-	img = imgSrc.Get()
-	history.Save(descr)
+func (s *session) getImage(descr string) {
+	if s.capture() {
+		s.save(descr)
+	}
+}
+
+// save adds the current image to the image-dump.
+func (s *session) save(descr string) {
+	if s.img() == nil {
+		return
+	}
+	f := history.Frame{Descr: descr, Phase: s.phase.String()}
+	f.Table, _ = s.windowName()
+	if s.h != nil {
+		f.HandID = s.h.HandID
+	}
+	if err := history.Save(s.img(), f); err != nil {
+		s.log.Warnf("failed to save image. %v", err)
+	}
+}
+
+// capture takes a new image without saving it and returns whether it got
+// one. The current image is kept if there is no new one, and the session ends
+// once the source has no more images.
+func (s *session) capture() bool {
+	img, err := s.imgSrc.Get()
+	switch {
+	case err == vision.ErrEndOfStream:
+		if !s.closed() {
+			s.log.Info("no more images")
+			s.close()
+		}
+		return false
+	case err != nil:
+		s.log.Warnf("failed to get image. %v", err)
+		return false
+	}
+	s.view.SetImage(img)
+	return true
 }
 
-// Get a new image until condition is met
-func waitImage(f func() bool, interval int, descr string) {
-	if img == nil {
-		getImage(descr)
+// Get a new image until condition is met. Gives up and returns false once
+// timeout ms worth of images have been polled (0 waits forever). Counting
+// polls rather than wall time keeps history replays deterministic.
+func (s *session) waitImage(f func() bool, interval, timeout int, descr string) bool {
+	if s.img() == nil {
+		s.getImage(descr)
+	}
+
+	for polls := 0; !f(); polls++ {
+		if s.closed() {
+			return false
+		}
+		if timeout > 0 && polls*interval >= timeout {
+			s.save(descr + "Timeout")
+			return false
+		}
+		s.sleep(interval)
+		s.capture()
 	}
+	s.save(descr)
+	return true
+}
 
-	for !f() {
-		sleep(interval)
-		img = imgSrc.Get()
+// Read from new images while the reading is uncertain, at most maxRereads
+// times. Returns false if the last reading is still uncertain.
+func (s *session) reread(f func() vision.Confidence, descr string) bool {
+	for i := 0; f().Uncertain(); i++ {
+		if i == maxRereads {
+			return false
+		}
+		s.sleep(pollInterval)
+		s.getImage(descr)
 	}
-	history.Save(descr)
+	return true
+}
+
+// frames are the images of a region which is read until it is stable.
+type frames struct {
+	s      *session
+	region string
 }
 
-func sleep(ms int) {
+func (f frames) Get() (image.Image, error) {
+	f.s.sleep(frameInterval)
+	f.s.getImage(f.region)
+	if f.s.closed() {
+		return nil, vision.ErrEndOfStream
+	}
+	return f.s.img(), nil
+}
+
+// stable reads a region from the current image and the images after it until
+// the reading is stable (see vision.Stable). Readings from several images are
+// recorded in the hand.
+func (s *session) stable(region string,
+	read func(image.Image) (interface{}, vision.Confidence, error)) vision.Reading {
+
+	r := vision.Stable(frames{s, region}, s.img(), region, read)
+	s.view.SetImage(r.Image)
+	if r.Frames > 1 {
+		s.log.Infof("read %v from %v images, stable: %v", region, r.Frames,
+			r.Stable)
+		if s.h != nil {
+			s.h.Readings = append(s.h.Readings, handhistory.Reading{
+				Region: region,
+				Frames: r.Frames,
+				Stable: r.Stable,
+			})
+		}
+	}
+	return r
+}
+
+// markUncertain adds a field of the hand to the uncertain fields.
+func (s *session) markUncertain(format string, args ...interface{}) {
+	field := fmt.Sprintf(format, args...)
+	s.log.Warnf("uncertain reading of %v", field)
+	s.h.Uncertain = append(s.h.Uncertain, field)
+}
+
+// sleep waits between images. A history paces the images itself.
+func (s *session) sleep(ms int) {
 	if usingHistory {
 		return
 	}
@@ -424,6 +1000,11 @@ func sleep(ms int) {
 	time.Sleep(time.Millisecond * time.Duration(ms))
 }
 
-func performFold() {
-	window.Get().PressKey("F1")
+// performFold folds our hand. A history is replayed without any input.
+func (s *session) performFold() {
+	if usingHistory {
+		return
+	}
+
+	s.win.PressKey("F1")
 }
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/whomever000/poker-client-pokerstars/history"
+	"github.com/whomever000/poker-common"
+	"github.com/whomever000/poker-common/card"
+)
+
+// This file contains the record and label commands. The record command saves
+// the images of the tables whenever they change, along with what vision
+// reads from them, without following the hands. The label command corrects
+// those readings, which makes the dump a dataset for tuning the reference
+// files and for regression tests.
+
+// record runs the record command.
+func record(args []string) error {
+	fs := flag.NewFlagSet("record", flag.ExitOnError)
+	name := fs.String("w", "Play Money", "name of the table windows to record")
+	regions := fs.String("r", "", "regions whose changes are recorded, by "+
+		"prefix, e.g. pot,plBet (default: all)")
+	interval := fs.Int("i", pollInterval, "time between two images (ms)")
+	fs.Parse(args)
+
+	if fs.NArg() != 0 {
+		return fmt.Errorf("usage: record [-w <window>] [-r <regions>] " +
+			"[-i <ms>]")
+	}
+
+	var prefixes []string
+	if *regions != "" {
+		prefixes = strings.Split(*regions, ",")
+	}
+
+	log.Infof("recording to the dump of PID %v", os.Getpid())
+	watchTables(*name, nil, func(s *session) {
+		s.record(prefixes, *interval)
+	})
+	return nil
+}
+
+// record saves the images of the table in which one of the regions changed,
+// until the table is closed.
+func (s *session) record(prefixes []string, interval int) {
+	// A table which fails does not stop the others.
+	defer func() {
+		if r := recover(); r != nil {
+			s.log.Errorf("stopped recording the table. %v", r)
+		}
+	}()
+
+	var last map[string]uint64
+	for !s.closed() {
+		if s.capture() {
+			hashes, err := s.view.RegionHashes(s.img(), prefixes)
+			switch {
+			case err != nil:
+				s.log.Warnf("failed to compare the regions. %v", err)
+			case changed(last, hashes):
+				last = hashes
+				f := history.Frame{Descr: "record", Readings: s.readings()}
+				f.Table, _ = s.windowName()
+				if err := history.Save(s.img(), f); err != nil {
+					s.log.Warnf("failed to save image. %v", err)
+				}
+			}
+		}
+		s.sleep(interval)
+	}
+}
+
+// changed returns whether any region hashes differently.
+func changed(last, hashes map[string]uint64) bool {
+	if len(last) != len(hashes) {
+		return true
+	}
+	for name, h := range hashes {
+		if last[name] != h {
+			return true
+		}
+	}
+	return false
+}
+
+// readings returns what vision reads from the current image, by the region
+// or the regions it is read from. Readings which fail are left out.
+func (s *session) readings() map[string]string {
+	img := s.img()
+	ret := make(map[string]string)
+	add := func(key string, v interface{}, err error) {
+		if err == nil {
+			ret[key] = fmt.Sprint(v)
+		}
+	}
+
+	pot, _, err := s.view.Pot(img)
+	add("pot", pot, err)
+	comm, _, err := s.view.CommunityCards(img)
+	add("comm", cardsString(comm), err)
+	button, err := s.view.ButtonPosition(img)
+	add("button", int(button), err)
+	current, err := s.view.CurrentPlayer(img)
+	add("current", int(current), err)
+
+	for i := 0; i < s.view.Seats(); i++ {
+		pos := poker.PlayerPosition(i + 1)
+		status, _, err := s.view.SeatStatus(img, pos)
+		add(fmt.Sprintf("seat%v", i), status, err)
+		name, _, err := s.view.PlayerName(img, pos)
+		add(fmt.Sprintf("plName%v", i), name, err)
+		stack, _, err := s.view.PlayerStack(img, pos)
+		add(fmt.Sprintf("plStack%v", i), stack, err)
+		bet, _, err := s.view.PlayerBet(img, pos)
+		add(fmt.Sprintf("plBet%v", i), bet, err)
+		action, _, err := s.view.PlayerAction(img, pos)
+		add(fmt.Sprintf("plAction%v", i), action, err)
+		shown, _, err := s.view.ShownCards(img, pos)
+		add(fmt.Sprintf("shown%v", i), cardsString(shown), err)
+	}
+	return ret
+}
+
+// cardsString returns cards separated by spaces, e.g. "Ah Kd".
+func cardsString(cards []card.Card) string {
+	strs := make([]string, len(cards))
+	for i, c := range cards {
+		strs[i] = c.String()
+	}
+	return strings.Join(strs, " ")
+}
+
+// label runs the label command.
+func label(args []string) error {
+	fs := flag.NewFlagSet("label", flag.ExitOnError)
+	pid := fs.Int("h", 0, "pid of history")
+	fs.Parse(args)
+
+	if *pid == 0 || fs.NArg() < 1 {
+		return fmt.Errorf("usage: label -h <pid> <seq> [<region>=<value> ...]")
+	}
+	seq, err := strconv.Atoi(fs.Arg(0))
+	if err != nil {
+		return fmt.Errorf("invalid sequence number %q", fs.Arg(0))
+	}
+
+	frames, err := history.List(*pid)
+	if err != nil {
+		return err
+	}
+	var frame *history.Frame
+	for i := range frames {
+		if frames[i].Seq == seq {
+			frame = &frames[i]
+		}
+	}
+	if frame == nil {
+		return fmt.Errorf("no frame %v in the dump of %v", seq, *pid)
+	}
+
+	// Without labels, show the readings of the frame.
+	if fs.NArg() == 1 {
+		printReadings(*frame)
+		return nil
+	}
+
+	var labels []history.Label
+	for _, arg := range fs.Args()[1:] {
+		kv := strings.SplitN(arg, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return fmt.Errorf("invalid label %q, expected <region>=<value>",
+				arg)
+		}
+		labels = append(labels, history.Label{Seq: seq, Region: kv[0],
+			Value: kv[1]})
+	}
+	return history.AddLabels(*pid, labels)
+}
+
+// printReadings prints the readings of a frame, marking those corrected by a
+// label with "*".
+func printReadings(f history.Frame) {
+	regions := make(map[string]bool)
+	for region := range f.Readings {
+		regions[region] = true
+	}
+	for region := range f.Labels {
+		regions[region] = true
+	}
+
+	var sorted []string
+	for region := range regions {
+		sorted = append(sorted, region)
+	}
+	sort.Strings(sorted)
+
+	for _, region := range sorted {
+		v, _ := f.Reading(region)
+		mark := " "
+		if _, ok := f.Labels[region]; ok {
+			mark = "*"
+		}
+		fmt.Printf("%v %v: %q\n", mark, region, v)
+	}
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/whomever000/poker-client-pokerstars/handhistory"
+	"github.com/whomever000/poker-client-pokerstars/history"
+	"github.com/whomever000/poker-client-pokerstars/vision"
+	"github.com/whomever000/poker-common"
+	"github.com/whomever000/poker-common/window"
+)
+
+// This file contains the table sessions. Every table window is followed by a
+// session of its own, which runs in its own goroutine.
+
+// session is the state of a single table.
+type session struct {
+	win    window.Window
+	view   *vision.Table
+	imgSrc vision.ImageSource
+	h      *handhistory.Hand
+	out    *sink
+	log    *log.Entry
+
+	better        poker.PlayerPosition
+	activePlayers []poker.PlayerPosition
+	allInPlayers  []poker.PlayerPosition
+	playerStacks  []poker.Amount
+	// playerBets are the bets of the players in the current betting round.
+	playerBets []poker.Amount
+	// posted are the forced bets of the current hand.
+	posted []poker.PlayerAction
+
+	// hands is the number of hands seen at the table.
+	hands int
+	// phase is the phase of the current hand.
+	phase phase
+
+	// quit is closed when the table window was closed, once.
+	quit      chan struct{}
+	closeOnce sync.Once
+}
+
+func newSession(win window.Window, name string, imgSrc vision.ImageSource,
+	out *sink) *session {
+
+	table := name
+	if strs := strings.Split(name, " - "); len(strs) >= 3 {
+		table = strs[0]
+	}
+
+	view := vision.NewTable()
+	view.Debug = true
+
+	return &session{
+		win:    win,
+		view:   view,
+		imgSrc: imgSrc,
+		out:    out,
+		log:    log.WithField("table", table),
+		phase:  phaseComplete,
+		quit:   make(chan struct{}),
+	}
+}
+
+// windowNameOf returns the name of the table window. A history has no window,
+// its frames have the name the window had when they were saved.
+func windowNameOf(win window.Window, imgSrc vision.ImageSource) (string, error) {
+	if win != nil {
+		return win.Name()
+	}
+	if src, ok := imgSrc.(*history.ImageSource); ok {
+		f, err := src.Frame()
+		return f.Table, err
+	}
+	return "", fmt.Errorf("no window")
+}
+
+// windowName returns the name of the table window of the session.
+func (s *session) windowName() (string, error) {
+	return windowNameOf(s.win, s.imgSrc)
+}
+
+// img returns the current image of the table.
+func (s *session) img() image.Image {
+	return s.view.Image()
+}
+
+// run follows the hands of the table until it is closed.
+func (s *session) run() {
+	// A table which fails does not stop the others.
+	defer func() {
+		if r := recover(); r != nil {
+			s.log.Errorf("stopped following the table. %v", r)
+		}
+	}()
+
+	for {
+
+		// Wait for new hand.
+		// Wait for pocket cards to be delt.
+		if s.NewHand() == "" {
+			return
+		}
+
+		s.performFold()
+
+		// Follow the action until the hand is complete. A table which
+		// closes, or a history which ends, ends the hand early.
+		s.playHand()
+		if s.closed() {
+			s.log.Warn("stopped during the hand")
+		}
+
+		s.out.hand(s.returnHand(), s.h)
+	}
+}
+
+// close stops the session once it is done with the current image. It may be
+// called any number of times, from any goroutine.
+func (s *session) close() {
+	s.closeOnce.Do(func() {
+		close(s.quit)
+	})
+}
+
+// closed returns whether the table window was closed.
+func (s *session) closed() bool {
+	select {
+	case <-s.quit:
+		return true
+	default:
+		return false
+	}
+}
+
+// sink receives the hands of all tables.
+type sink struct {
+	mu       sync.Mutex
+	exporter *handhistory.Exporter
+
+	// hands is the number of hands received, uncertain those of them with
+	// uncertain readings and failed those which failed to be exported.
+	hands, uncertain, failed int
+}
+
+// hand prints and exports a finished hand.
+func (o *sink) hand(text string, h *handhistory.Hand) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.hands++
+	if len(h.Uncertain) > 0 {
+		o.uncertain++
+	}
+
+	fmt.Println(text)
+	if err := o.exporter.Export(h); err != nil {
+		log.Errorf("failed to export hand. %v", err)
+		o.failed++
+	}
+}
+
+// summary describes the hands received.
+func (o *sink) summary() string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	return fmt.Sprintf("%v hands, %v with uncertain readings, %v failed to "+
+		"export", o.hands, o.uncertain, o.failed)
+}
+
+// discoverInterval is the time between two looks for opened and closed
+// tables (ms).
+const discoverInterval = 2000
+
+// watchTables follows every window whose name contains the given name, by
+// running follow with the session of each table. Tables which open are
+// attached to, and the sessions of tables which close are stopped.
+func watchTables(windowName string, out *sink, follow func(*session)) {
+	sessions := make(map[string]*session)
+	done := make(chan string)
+
+	for {
+		names, err := windowNames()
+		if err != nil {
+			if len(sessions) > 0 {
+				log.Warnf("failed to list windows. %v", err)
+			} else {
+				// Without a list of the windows, follow a single table.
+				log.Warnf("failed to list windows, following a single "+
+					"table. %v", err)
+				s, err := Attach(windowName, nil, out)
+				if err != nil {
+					return
+				}
+				follow(s)
+				return
+			}
+		}
+
+		open := make(map[string]bool)
+		for _, name := range names {
+			if !strings.Contains(name, windowName) {
+				continue
+			}
+			key := history.TableName(name)
+			open[key] = true
+			if _, ok := sessions[key]; ok {
+				continue
+			}
+
+			s, err := Attach(name, nil, out)
+			if err != nil {
+				continue
+			}
+			sessions[key] = s
+			go func(key string) {
+				follow(s)
+				done <- key
+			}(key)
+		}
+
+		// Stop the sessions of closed tables, they end after their current
+		// image.
+		if err == nil {
+			for key, s := range sessions {
+				if !open[key] {
+					s.close()
+				}
+			}
+		}
+
+		select {
+		case key := <-done:
+			log.Infof("stopped following '%v'", key)
+			delete(sessions, key)
+		case <-time.After(discoverInterval * time.Millisecond):
+		}
+	}
+}
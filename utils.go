@@ -3,14 +3,17 @@ package main
 import (
 	"bytes"
 	"io"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
-	"os"
-
+	"github.com/whomever000/poker-client-pokerstars/handhistory"
 	"github.com/whomever000/poker-client-pokerstars/vision"
 	poker "github.com/whomever000/poker-common"
-	"github.com/whomever000/poker-common/window"
+	"github.com/whomever000/poker-common/card"
 
 	log "github.com/Sirupsen/logrus"
 )
@@ -27,40 +30,59 @@ func client() string {
 }
 
 // table returns the details of the table.
-func table() poker.Table {
+func (s *session) table() poker.Table {
 
 	var table poker.Table
 
 	// Get window name.
-	name, err := window.Get().Name()
+	name, err := s.windowName()
 	if err != nil {
-		log.Warnf("failed to get window name. %v", err)
+		s.log.Warnf("failed to get window name. %v", err)
 	}
 
 	strs := strings.Split(name, " - ")
 	if len(strs) < 3 {
-		log.Errorf("expected three or more substrings in window name. Got: %v", name)
+		s.log.Errorf("expected three or more substrings in window name. Got: %v", name)
 		return table
 	}
 
 	table.Name = strs[0]
 	table.Stakes, err = poker.ParseStakes(strs[1])
 	if err != nil {
-		log.Errorf("failed to parse table stakes. %v", err)
+		s.log.Errorf("failed to parse table stakes. %v", err)
 	}
-	// TODO: allow other table sizes.
-	table.Size = 6
+	table.Size = s.view.Seats()
 	table.Game, err = poker.ParseGame(strs[2])
 	if err != nil {
-		log.Errorf("failed to parse game. %v", err)
+		s.log.Errorf("failed to parse game. %v", err)
 	}
 
 	return table
 }
 
-// handID returns current hand ID.
-func handID() int {
-	return os.Getpid()
+// reHandID matches the hand number in a window name, e.g. "#167000000001".
+var reHandID = regexp.MustCompile(`#(\d+)`)
+
+// lastHandID is the last number given to a hand without a number on the site.
+// It is shared by all tables, so that their hands do not get the same number.
+var lastHandID int64
+
+// handID returns the number of the hand on the site, which is shown in the
+// window name. Without one, it is the next number of lastHandID.
+func (s *session) handID() int {
+	name, err := s.windowName()
+	if err != nil {
+		s.log.Warnf("failed to get window name. %v", err)
+	}
+	if match := reHandID.FindStringSubmatch(name); match != nil {
+		if id, err := strconv.Atoi(match[1]); err == nil {
+			return id
+		}
+	}
+
+	id := int(atomic.AddInt64(&lastHandID, 1))
+	s.log.Warnf("no hand number in window name '%v', using %v", name, id)
+	return id
 }
 
 // date returns the time the hand was started.
@@ -68,61 +90,242 @@ func date() poker.Date {
 	return poker.Date(time.Now())
 }
 
-// button returns the current button position.
-func button() poker.PlayerPosition {
-	return vision.ButtonPosition(img)
+// button returns the current button position, or 0 if it cannot be read.
+func (s *session) button() poker.PlayerPosition {
+	pos, err := s.view.ButtonPosition(s.img())
+	if err != nil {
+		s.log.Warnf("failed to read the button. %v", err)
+	}
+	return pos
 }
 
-// smallBlind returns the small blind position.
-func smallBlind() poker.PlayerPosition {
-	return nextActivePlayer(h.Button)
-}
+// posts reads the forced bets in front of the players at the start of a hand,
+// and sets the small and big blind from them. It returns the posts with the
+// small blind first. A blind which is not in front of the players is taken to
+// be posted by the player after the button, or after the small blind.
+func (s *session) posts() []poker.PlayerAction {
+	stakes := s.h.Table.Stakes
+	n := s.view.Seats()
+	s.playerBets = make([]poker.Amount, n)
+
+	var posts []poker.PlayerAction
+	post := func(pos poker.PlayerPosition, p handhistory.Post, a poker.Amount) {
+		posts = append(posts, poker.PlayerAction{
+			Position: pos,
+			Action:   handhistory.PostAction{Post: p, Amount: a},
+		})
+	}
+
+	// Heads-up the button posts the small blind, so the seats are read from
+	// the button on.
+	var bets poker.Amount
+	pos := s.h.Button
+	for i := 0; i < n; i++ {
+		if i > 0 {
+			pos = poker.NextPlayerPosition(pos, n)
+		}
+		if !hasPosition(s.activePlayers, pos) {
+			continue
+		}
+		bet, c, err := s.view.PlayerBet(s.img(), pos)
+		if err != nil || bet <= 0 {
+			continue
+		}
+		if c.Uncertain() {
+			s.markUncertain("Rounds[0].Actions")
+		}
+		s.playerBets[pos-1] = bet
+		bets += bet
+
+		switch {
+		case bet == stakes.SmallBlind && s.h.SmallBlind == 0 &&
+			(pos != s.h.Button || len(s.activePlayers) == 2):
+			s.h.SmallBlind = pos
+			post(pos, handhistory.PostSmallBlind, bet)
+		case bet == stakes.BigBlind && s.h.BigBlind == 0:
+			s.h.BigBlind = pos
+			post(pos, handhistory.PostBigBlind, bet)
+		case bet == stakes.BigBlind:
+			// A player new to the table posts the big blind to be dealt in.
+			post(pos, handhistory.PostBigBlind, bet)
+		case bet == stakes.SmallBlind+stakes.BigBlind:
+			// A player who missed the blinds posts both, the small blind is
+			// dead.
+			post(pos, handhistory.PostBothBlinds, bet)
+			s.playerBets[pos-1] = stakes.BigBlind
+		case bet > stakes.BigBlind:
+			post(pos, handhistory.PostStraddle, bet)
+		default:
+			s.log.Warnf("unexpected post of %v by player %v", bet, pos)
+			s.markUncertain("Rounds[0].Actions")
+			post(pos, handhistory.PostBigBlind, bet)
+		}
+	}
+
+	// blind adds a missing blind, unless another bet was read in front of
+	// the player. If the player after the button posted the big blind, the
+	// small blind is dead.
+	blind := func(pos poker.PlayerPosition, p handhistory.Post,
+		a poker.Amount) {
+
+		if s.playerBets[pos-1] == 0 {
+			post(pos, p, a)
+			s.playerBets[pos-1] = a
+			bets += a
+		}
+	}
+	if s.h.SmallBlind == 0 {
+		sb := s.nextActivePlayer(s.h.Button)
+		if len(s.activePlayers) == 2 {
+			sb = s.h.Button
+		}
+		if sb != 0 && sb != s.h.BigBlind {
+			s.log.Warn("no small blind in front of the players")
+			s.markUncertain("SmallBlind")
+			s.h.SmallBlind = sb
+			blind(sb, handhistory.PostSmallBlind, stakes.SmallBlind)
+		}
+	}
+	if s.h.BigBlind == 0 {
+		from := s.h.SmallBlind
+		if from == 0 {
+			from = s.h.Button
+		}
+		if bb := s.nextActivePlayer(from); bb != 0 {
+			s.log.Warn("no big blind in front of the players")
+			s.markUncertain("BigBlind")
+			s.h.BigBlind = bb
+			blind(bb, handhistory.PostBigBlind, stakes.BigBlind)
+		}
+	}
+
+	sort.SliceStable(posts, func(i, j int) bool {
+		return posts[i].Action.(handhistory.PostAction).Post <
+			posts[j].Action.(handhistory.PostAction).Post
+	})
 
-// bigBlind returns the big blind position.
-func bigBlind() poker.PlayerPosition {
-	return nextActivePlayer(h.SmallBlind)
+	// Antes go into the pot right away. The pot shows them along with the
+	// bets in front of the players.
+	pot, c, err := s.view.Pot(s.img())
+	if err != nil || c.Uncertain() || pot <= bets {
+		return posts
+	}
+	dealt := poker.Amount(len(s.activePlayers))
+	ante := (pot - bets) / dealt
+	if ante*dealt != pot-bets {
+		s.log.Warnf("pot of %v does not add up to the bets of %v and antes",
+			pot, bets)
+		s.markUncertain("Rounds[0].Actions")
+		return posts
+	}
+	for _, pos := range s.activePlayers {
+		post(pos, handhistory.PostAnte, ante)
+	}
+	return posts
 }
 
-// thisPlayer returns information about 'me'.
-func thisPlayer() *poker.PlayerCards {
-	cards, err := vision.PocketCards(img)
+// thisPlayer returns information about 'me'. Our seat is the one of our
+// screen name, or else the one whose hole cards are face up. It returns nil if
+// we were not dealt in.
+func (s *session) thisPlayer() *poker.PlayerCards {
+	var hero poker.PlayerPosition
+	if heroName != "" {
+		for i, p := range s.h.Players {
+			if p.Name == heroName {
+				hero = poker.PlayerPosition(i + 1)
+			}
+		}
+		if hero == 0 {
+			s.log.Warnf("%v is not at the table", heroName)
+		}
+	}
+
+	pos := hero
+	var cards []card.Card
+	var err error
+	if !s.reread(func() (c vision.Confidence) {
+		if hero != 0 {
+			cards, c, err = s.view.ShownCards(s.img(), hero)
+			return c
+		}
+		pos, cards, c, err = s.view.HoleCards(s.img())
+		return c
+	}, "rereadPocketCards") {
+		s.markUncertain("ThisPlayer.Cards")
+	}
 	if err != nil {
-		//log.Printf("error: Failed to get pocket cards. %v", err)
+		s.log.Warnf("failed to get pocket cards. %v", err)
+		return nil
+	}
+	if pos == 0 || len(cards) != 2 {
 		return nil
 	}
 
 	return &poker.PlayerCards{
-		Position: 4,
+		Position: pos,
 		Cards:    cards,
 	}
 }
 
-// players returns information about all players.
-func players() []poker.Player {
-
-	sync := make(chan bool, 6)
-
-	players := make([]poker.Player, 6)
-	for i := 0; i < 6; i++ {
+// players returns information about the players at the table, and records
+// the status of every seat in the hand. Empty and reserved seats have no
+// player.
+func (s *session) players() []poker.Player {
+
+	n := s.view.Seats()
+	sync := make(chan bool, n)
+
+	s.playerStacks = make([]poker.Amount, n)
+	s.h.Status = make([]string, n)
+	players := make([]poker.Player, n)
+	statusConf := make([]vision.Confidence, n)
+	nameConf := make([]vision.Confidence, n)
+	stackConf := make([]vision.Confidence, n)
+	for i := 0; i < n; i++ {
 		index := i
 		go func() {
-			name, _ := vision.PlayerName(img, poker.PlayerPosition(index+1))
-			stack, err := vision.PlayerStack(img, poker.PlayerPosition(index+1))
-			if err != nil {
-				panic(err)
+			defer func() { sync <- true }()
+
+			pos := poker.PlayerPosition(index + 1)
+			seat, err := s.view.Seat(s.img(), pos)
+			s.h.Status[index] = seat.Status.String()
+			statusConf[index] = seat.StatusConfidence
+			if err != nil || !seat.Status.Occupied() {
+				return
 			}
-			log.Infof("%v:\t%v", name, stack)
 
-			players[index] = poker.Player{Name: name, Stack: stack}
-			playerStacks[index] = stack
-			sync <- true
+			// A player who sits out shows no stack, one who is all-in has
+			// none left.
+			s.log.Infof("%v:\t%v (%v)", seat.Name, seat.Stack, seat.Status)
+
+			players[index] = poker.Player{Name: seat.Name, Stack: seat.Stack}
+			s.playerStacks[index] = seat.Stack
+			nameConf[index] = seat.NameConfidence
+			stackConf[index] = seat.StackConfidence
 		}()
 	}
 
-	for i := 0; i < 6; i++ {
+	for i := 0; i < n; i++ {
 		<-sync
 	}
 
+	// The image is read by all players at once, so uncertain readings are
+	// only marked.
+	for i := 0; i < n; i++ {
+		if statusConf[i].Uncertain() {
+			s.markUncertain("Status[%d]", i)
+		}
+		if players[i].Name == "" {
+			continue
+		}
+		if nameConf[i].Uncertain() {
+			s.markUncertain("Players[%d].Name", i)
+		}
+		if stackConf[i].Uncertain() {
+			s.markUncertain("Players[%d].Stack", i)
+		}
+	}
+
 	return players
 }
 
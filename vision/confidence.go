@@ -0,0 +1,243 @@
+package vision
+
+import (
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/png"
+	"math"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// Confidence is how sure a reading is, from 0 (a guess) to 1 (certain).
+//
+// Regions read by comparing them with reference images are scored by how much
+// better the best reference matches than one of another value. The matcher
+// does not report how certain its OCR is, so text is scored by whether it is
+// well formed.
+type Confidence float64
+
+// threshold is the confidence below which a reading is uncertain.
+var threshold Confidence = 0.2
+
+// SetThreshold sets the confidence below which readings are uncertain.
+func SetThreshold(c Confidence) {
+	threshold = c
+}
+
+// Uncertain returns whether the confidence is below the threshold.
+func (c Confidence) Uncertain() bool {
+	return c < threshold
+}
+
+// minConfidence returns the lowest of the confidences.
+func minConfidence(cs ...Confidence) Confidence {
+	ret := Confidence(1)
+	for _, c := range cs {
+		if c < ret {
+			ret = c
+		}
+	}
+	return ret
+}
+
+// region is a region of the reference file and the references it is
+// compared with.
+type region struct {
+	rect image.Rectangle
+	refs []string
+}
+
+// references are the regions and reference images of a layout, as far as
+// vision needs them to score readings.
+type references struct {
+	regions map[string]region
+	images  map[string]image.Image
+}
+
+// readReferences reads the regions and reference images of a reference file.
+func readReferences(file string) (*references, error) {
+	r, err := load(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var f struct {
+		Srcs []struct {
+			Name string
+			Src  []int
+			Refs []string
+		}
+		Refs []struct {
+			Name string
+			Ref  string
+		}
+	}
+	if err := json.NewDecoder(r).Decode(&f); err != nil {
+		return nil, err
+	}
+
+	ret := &references{
+		regions: make(map[string]region),
+		images:  make(map[string]image.Image),
+	}
+	for _, s := range f.Srcs {
+		if len(s.Src) != 4 {
+			// A single pixel, which is only compared with a color.
+			continue
+		}
+		ret.regions[s.Name] = region{
+			rect: image.Rect(s.Src[0], s.Src[1], s.Src[0]+s.Src[2],
+				s.Src[1]+s.Src[3]),
+			refs: s.Refs,
+		}
+	}
+	for _, ref := range f.Refs {
+		i := strings.Index(ref.Ref, ":")
+		if i < 0 || !strings.HasPrefix(ref.Ref[:i], "image") {
+			continue
+		}
+		img, err := loadImage(ref.Ref[i+1:])
+		if err != nil {
+			return nil, fmt.Errorf("failed to load %v. %v", ref.Ref[i+1:], err)
+		}
+		ret.images[ref.Name] = img
+	}
+	return ret, nil
+}
+
+// loadImage loads an image through the file loader.
+func loadImage(file string) (image.Image, error) {
+	r, err := load(file)
+	if err != nil {
+		return nil, err
+	}
+	img, _, err := image.Decode(r)
+	return img, err
+}
+
+// labelDistance is the distance from a reference image below which a region
+// looks like the reference, so that a region reading no reference is only
+// certain if it is this far from all of them.
+const labelDistance = 0.25
+
+// refValue returns the value a reference image reads as. Variants of a
+// reference, e.g. "actionFold_bright" of "actionFold", read as the same value.
+func refValue(name string) string {
+	if i := strings.Index(name, "_"); i >= 0 {
+		return name[:i]
+	}
+	return name
+}
+
+// matchConfidence returns the confidence of the reading of a region which is
+// compared with reference images, given the reference it was read as or ""
+// if it was read as none. A reading is scored by how much better the best
+// reference matches than the best reference of another value, so variants of
+// a reference do not make it uncertain.
+func (t *Table) matchConfidence(img image.Image, src, read string) Confidence {
+	refs := t.layout.refs
+	if refs == nil {
+		return 0
+	}
+	r, ok := refs.regions[src]
+	if !ok {
+		return 0
+	}
+
+	// The distance of the closest reference of each value.
+	dists := make(map[string]float64)
+	for _, name := range r.refs {
+		if ref, ok := refs.images[name]; ok {
+			d := distance(img, r.rect, ref)
+			if best, ok := dists[refValue(name)]; !ok || d < best {
+				dists[refValue(name)] = d
+			}
+		}
+	}
+	var sorted []float64
+	for _, d := range dists {
+		sorted = append(sorted, d)
+	}
+	sort.Float64s(sorted)
+
+	switch {
+	case len(sorted) == 0:
+		return 0
+	case read == "":
+		// No label is certain if no reference looks like the region.
+		return Confidence(math.Min(1, sorted[0]/labelDistance))
+	case len(sorted) == 1:
+		return Confidence(1 - sorted[0])
+	case sorted[1] == 0:
+		// References of two values match perfectly.
+		return 0
+	}
+	return Confidence(1 - sorted[0]/sorted[1])
+}
+
+// distance returns how much a reference image differs from the region of the
+// image where it fits best, from 0 (the same) to 1. Transparent pixels of the
+// reference are ignored.
+func distance(img image.Image, rect image.Rectangle, ref image.Image) float64 {
+	rb := ref.Bounds()
+	best := 1.0
+
+	for y := rect.Min.Y; y == rect.Min.Y || y+rb.Dy() <= rect.Max.Y; y++ {
+		for x := rect.Min.X; x == rect.Min.X || x+rb.Dx() <= rect.Max.X; x++ {
+
+			var sum, weight float64
+			for ry := rb.Min.Y; ry < rb.Max.Y; ry++ {
+				for rx := rb.Min.X; rx < rb.Max.X; rx++ {
+					c := color.NRGBAModel.Convert(ref.At(rx, ry)).(color.NRGBA)
+					if c.A == 0 {
+						continue
+					}
+					p := color.NRGBAModel.Convert(
+						img.At(x+rx-rb.Min.X, y+ry-rb.Min.Y)).(color.NRGBA)
+
+					w := float64(c.A) / 255
+					sum += w * (math.Abs(float64(c.R)-float64(p.R)) +
+						math.Abs(float64(c.G)-float64(p.G)) +
+						math.Abs(float64(c.B)-float64(p.B))) / (3 * 255)
+					weight += w
+				}
+			}
+
+			if weight > 0 && sum/weight < best {
+				best = sum / weight
+			}
+		}
+	}
+	return best
+}
+
+// amountConfidence returns the confidence of an amount read with OCR. It is 0
+// if the text is not an amount and lower if it had to be corrected.
+func amountConfidence(err error, corrected bool) Confidence {
+	switch {
+	case err != nil:
+		return 0
+	case corrected:
+		return 0.5
+	}
+	return 1
+}
+
+// textConfidence returns the confidence of text read with OCR. Empty text may
+// be an empty region as well as a failed reading, and characters which cannot
+// be printed are misread.
+func textConfidence(s string) Confidence {
+	if s == "" {
+		return 0.5
+	}
+	for _, r := range s {
+		if r == unicode.ReplacementChar || !unicode.IsPrint(r) {
+			return 0.5
+		}
+	}
+	return 1
+}
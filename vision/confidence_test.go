@@ -0,0 +1,60 @@
+package vision
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+// TestMatchConfidence verifies that a region which looks like one reference, or
+// like variants of one, is certain and one which looks like two references is
+// not, and that a region without a label is certain if it looks like none.
+func TestMatchConfidence(t *testing.T) {
+	uniform := func(c color.Color) image.Image {
+		img := image.NewRGBA(image.Rect(0, 0, 4, 4))
+		for y := 0; y < 4; y++ {
+			for x := 0; x < 4; x++ {
+				img.Set(x, y, c)
+			}
+		}
+		return img
+	}
+	black := color.RGBA{0, 0, 0, 255}
+	white := color.RGBA{255, 255, 255, 255}
+
+	all := image.Rect(0, 0, 4, 4)
+	tb := &Table{layout: &layout{refs: &references{
+		regions: map[string]region{
+			"distinct": {all, []string{"black", "white"}},
+			"alike":    {all, []string{"black", "black2"}},
+			"variants": {all, []string{"black", "black_bright", "white"}},
+			"black":    {all, []string{"black", "black_bright"}},
+		},
+		images: map[string]image.Image{
+			"black":        uniform(black),
+			"black2":       uniform(black),
+			"black_bright": uniform(black),
+			"white":        uniform(white),
+		},
+	}}}
+
+	img := uniform(black)
+	if c := tb.matchConfidence(img, "distinct", "black"); c.Uncertain() {
+		t.Errorf("Expected a certain reading, got %v", c)
+	}
+	if c := tb.matchConfidence(img, "alike", "black"); !c.Uncertain() {
+		t.Errorf("Expected an uncertain reading, got %v", c)
+	}
+	if c := tb.matchConfidence(img, "variants", "black_bright"); c.Uncertain() {
+		t.Errorf("Expected a certain reading of a variant, got %v", c)
+	}
+	if c := tb.matchConfidence(img, "black", ""); !c.Uncertain() {
+		t.Errorf("Expected an uncertain reading of no label, got %v", c)
+	}
+	if c := tb.matchConfidence(uniform(white), "black", ""); c.Uncertain() {
+		t.Errorf("Expected a certain reading of no label, got %v", c)
+	}
+	if c := tb.matchConfidence(img, "unknown", "black"); c != 0 {
+		t.Errorf("Expected no confidence for an unknown region, got %v", c)
+	}
+}
@@ -0,0 +1,139 @@
+package vision
+
+import (
+	"fmt"
+	"image"
+	"strconv"
+	"strings"
+)
+
+// Chip animations and fading labels make single images misread now and then.
+// Regions which are prone to that are read from consecutive images until the
+// same value was read often enough.
+
+// Consensus is how a region is read from consecutive images.
+type Consensus struct {
+	// Frames is the most images the region is read from.
+	Frames int
+	// Agree is how many identical readings accept a value.
+	Agree int
+}
+
+// consensus are the consensus of the regions, by the prefix of their source
+// names. Other regions are read from a single image.
+var consensus = map[string]Consensus{
+	"pot":     {Frames: 3, Agree: 2},
+	"plStack": {Frames: 3, Agree: 2},
+	"plBet":   {Frames: 3, Agree: 2},
+}
+
+// SetConsensus sets how a region is read, e.g. "pot" or "plStack".
+func SetConsensus(region string, c Consensus) error {
+	if c.Frames < 1 || c.Agree < 1 || c.Agree > c.Frames {
+		return fmt.Errorf("invalid consensus %v/%v for %v", c.Frames, c.Agree,
+			region)
+	}
+	consensus[region] = c
+	return nil
+}
+
+// ParseConsensus sets the consensus of regions from a list like
+// "pot=5/3,plStack=3/2", which reads the pot from at most 5 images until 3
+// readings agree.
+func ParseConsensus(s string) error {
+	for _, f := range strings.Split(s, ",") {
+		if f == "" {
+			continue
+		}
+		var c Consensus
+		kv := strings.SplitN(f, "=", 2)
+		if len(kv) != 2 {
+			return fmt.Errorf("invalid consensus %q, expected region=frames/agree", f)
+		}
+		n := strings.SplitN(kv[1], "/", 2)
+		var err error
+		if c.Frames, err = strconv.Atoi(n[0]); err != nil {
+			return fmt.Errorf("invalid consensus %q. %v", f, err)
+		}
+		c.Agree = c.Frames
+		if len(n) == 2 {
+			if c.Agree, err = strconv.Atoi(n[1]); err != nil {
+				return fmt.Errorf("invalid consensus %q. %v", f, err)
+			}
+		}
+		if err := SetConsensus(kv[0], c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// consensusOf returns the consensus of a region.
+func consensusOf(region string) Consensus {
+	if c, ok := consensus[region]; ok {
+		return c
+	}
+	return Consensus{Frames: 1, Agree: 1}
+}
+
+// Reading is a value read from one or more images.
+type Reading struct {
+	Value      interface{}
+	Confidence Confidence
+	Err        error
+	// Image is the last image read.
+	Image image.Image
+	// Frames is the number of images read.
+	Frames int
+	// Stable is whether enough readings agreed on the value.
+	Stable bool
+}
+
+// Stable reads a region from img and then from the next images of src, until
+// the consensus of the region agrees on a value or src has no next image.
+// Readings which fail or are uncertain are not counted. Without an agreement,
+// the value read most often is returned with a confidence of 0, or the last
+// reading if none counted.
+func Stable(src ImageSource, img image.Image, region string,
+	read func(image.Image) (interface{}, Confidence, error)) Reading {
+
+	c := consensusOf(region)
+	counts := make(map[string]int)
+	var r, best Reading
+
+	for n := 1; ; n++ {
+		if n > 1 {
+			next, err := src.Get()
+			if err != nil {
+				break
+			}
+			img = next
+		}
+		v, conf, err := read(img)
+		r = Reading{Value: v, Confidence: conf, Err: err, Image: img, Frames: n}
+
+		if err == nil && !conf.Uncertain() {
+			// Values like cards are not comparable, their text is.
+			key := fmt.Sprint(v)
+			counts[key]++
+			if counts[key] >= c.Agree {
+				r.Stable = true
+				return r
+			}
+			if best.Frames == 0 || counts[key] > counts[fmt.Sprint(best.Value)] {
+				best = r
+			}
+		}
+
+		if n >= c.Frames {
+			break
+		}
+	}
+
+	if best.Frames == 0 {
+		return r
+	}
+	best.Confidence = 0
+	best.Image, best.Frames = r.Image, r.Frames
+	return best
+}
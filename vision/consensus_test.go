@@ -0,0 +1,102 @@
+package vision
+
+import (
+	"image"
+	"testing"
+)
+
+// nilSource is an image source whose images are all nil.
+type nilSource struct{}
+
+func (nilSource) Get() (image.Image, error) { return nil, nil }
+
+// endSource is an image source with n nil images.
+type endSource struct{ n *int }
+
+func (s endSource) Get() (image.Image, error) {
+	if *s.n == 0 {
+		return nil, ErrEndOfStream
+	}
+	*s.n--
+	return nil, nil
+}
+
+// TestStable verifies that a region is read until enough readings agree.
+func TestStable(t *testing.T) {
+	defer delete(consensus, "test")
+
+	tests := []struct {
+		name     string
+		cons     Consensus
+		readings []interface{}
+		value    interface{}
+		frames   int
+		stable   bool
+	}{
+		{"single", Consensus{1, 1}, []interface{}{1}, 1, 1, true},
+		{"flicker", Consensus{5, 3}, []interface{}{1, 7, 1, 1}, 1, 4, true},
+		{"majority", Consensus{3, 3}, []interface{}{1, 2, 2}, 2, 3, false},
+	}
+
+	for _, test := range tests {
+		if err := SetConsensus("test", test.cons); err != nil {
+			t.Fatal(err)
+		}
+		n := 0
+		r := Stable(nilSource{}, nil, "test",
+			func(image.Image) (interface{}, Confidence, error) {
+				n++
+				return test.readings[n-1], 1, nil
+			})
+
+		if r.Value != test.value || r.Frames != test.frames ||
+			r.Stable != test.stable {
+			t.Errorf("%v: Expected %v after %v frames (stable %v), got %v after "+
+				"%v frames (stable %v)", test.name, test.value, test.frames,
+				test.stable, r.Value, r.Frames, r.Stable)
+		}
+		if !test.stable && !r.Confidence.Uncertain() {
+			t.Errorf("%v: Expected an unstable reading to be uncertain", test.name)
+		}
+	}
+}
+
+// TestParseConsensus verifies the parsing of the consensus flag.
+func TestParseConsensus(t *testing.T) {
+	defer delete(consensus, "test")
+
+	if err := ParseConsensus("test=5/3"); err != nil {
+		t.Fatal(err)
+	}
+	if c := consensusOf("test"); c != (Consensus{5, 3}) {
+		t.Errorf("Expected 5/3, got %v/%v", c.Frames, c.Agree)
+	}
+	for _, s := range []string{"test", "test=x", "test=2/3"} {
+		if err := ParseConsensus(s); err == nil {
+			t.Errorf("%v: Expected an error", s)
+		}
+	}
+}
+
+// TestStableEnd verifies that a region is read until the images end.
+func TestStableEnd(t *testing.T) {
+	defer delete(consensus, "test")
+	if err := SetConsensus("test", Consensus{5, 3}); err != nil {
+		t.Fatal(err)
+	}
+
+	left := 1
+	readings := []interface{}{1, 2}
+	n := 0
+	r := Stable(endSource{&left}, nil, "test",
+		func(image.Image) (interface{}, Confidence, error) {
+			n++
+			return readings[n-1], 1, nil
+		})
+
+	if r.Value != 1 || r.Frames != 2 || r.Stable || !r.Confidence.Uncertain() {
+		t.Errorf("Expected an uncertain 1 after 2 frames, got %v after %v "+
+			"frames (stable %v, confidence %v)", r.Value, r.Frames, r.Stable,
+			r.Confidence)
+	}
+}
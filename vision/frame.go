@@ -0,0 +1,448 @@
+package vision
+
+import (
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"math"
+)
+
+// The captured image of a table does not have to start at the origin of the
+// table; window borders and title bars differ between machines. The frame of
+// the table is found from the felt, whose rectangle in the coordinates of the
+// reference file is in its "Felt" field, and then from the seats. Each seat is
+// anchored by the plate of the theme behind its name and stack.
+
+// seatPlateFile is the plate behind the name and stack of a seat, in the theme
+// of the tables.
+const seatPlateFile = "./other/PokerStars/Themes/black/label/status.png"
+
+// seatPlate is the opaque part of the plate behind the name and stack of a
+// seat. It is loaded by LoadReferences.
+var seatPlate image.Image
+
+// loadSeatPlate loads the seat plate.
+func loadSeatPlate() error {
+	img, err := loadImage(seatPlateFile)
+	if err != nil {
+		return fmt.Errorf("failed to load %v. %v", seatPlateFile, err)
+	}
+
+	b := img.Bounds()
+	var opaque image.Rectangle
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			if _, _, _, a := img.At(x, y).RGBA(); a == 0xffff {
+				opaque = opaque.Union(image.Rect(x, y, x+1, y+1))
+			}
+		}
+	}
+	sub, ok := img.(interface {
+		SubImage(image.Rectangle) image.Image
+	})
+	if opaque.Empty() || !ok {
+		return fmt.Errorf("%v has no opaque part", seatPlateFile)
+	}
+	seatPlate = sub.SubImage(opaque)
+	return nil
+}
+
+// Transform maps the coordinates of the reference file to those of an image:
+// image = Offset + Scale*reference.
+type Transform struct {
+	OffsetX, OffsetY float64
+	Scale            float64
+}
+
+var identity = Transform{Scale: 1}
+
+// Apply returns the image coordinates of a point of the reference file.
+func (t Transform) Apply(x, y float64) (float64, float64) {
+	return t.OffsetX + t.Scale*x, t.OffsetY + t.Scale*y
+}
+
+func (t Transform) String() string {
+	return fmt.Sprintf("offset (%.1f, %.1f), scale %.4f", t.OffsetX, t.OffsetY,
+		t.Scale)
+}
+
+// frameCache is the transform of the last image size of a table, as the frame
+// only changes when the window is resized.
+type frameCache struct {
+	layout *layout
+	size   image.Point
+	t      Transform
+}
+
+// detectFrame returns the transform of an image, detecting it when the size
+// of the image changes. The caller holds t.mu.
+func (t *Table) detectFrame(img image.Image) (Transform, error) {
+	size := img.Bounds().Size()
+	if size == t.frame.size && t.layout == t.frame.layout {
+		return t.frame.t, nil
+	}
+
+	tr, err := t.DetectFrame(img)
+	if err != nil {
+		return Transform{}, err
+	}
+
+	t.frame = frameCache{t.layout, size, tr}
+	return tr, nil
+}
+
+// DetectFrame returns the transform from the selected layout to the table in
+// the image. The table is found by its felt. If there is no felt, the image is
+// taken to be the table itself. The transform is then corrected by the seats
+// found near where the felt puts them. It fails when the aspect ratio of the
+// table differs from that of the layout.
+func (t *Table) DetectFrame(img image.Image) (Transform, error) {
+	tr, err := t.detectFelt(img)
+	if err != nil {
+		return Transform{}, err
+	}
+	tr = t.fitSeats(img, tr)
+
+	// Round to whole pixels, so that an unscaled table is not interpolated.
+	if math.Abs(tr.Scale-1) < 0.005 {
+		tr = Transform{math.Floor(tr.OffsetX + 0.5), math.Floor(tr.OffsetY + 0.5), 1}
+	}
+	return tr, nil
+}
+
+// detectFelt returns the transform from the selected layout to the table in
+// the image as given by the felt.
+func (t *Table) detectFelt(img image.Image) (Transform, error) {
+	refSize, refFelt := t.layout.size, t.layout.felt
+	felt, ok := findFelt(img)
+	if !ok {
+		// Scale the whole image.
+		felt = img.Bounds()
+		if felt.Dx() <= 0 || felt.Dy() <= 0 {
+			return Transform{}, fmt.Errorf("empty table image")
+		}
+		if !sameAspect(felt.Size(), refSize) {
+			return Transform{}, fmt.Errorf("unsupported table size %vx%v, "+
+				"the aspect ratio has to be that of %vx%v", felt.Dx(), felt.Dy(),
+				refSize.X, refSize.Y)
+		}
+		s := float64(felt.Dx()) / float64(refSize.X)
+		return Transform{float64(felt.Min.X), float64(felt.Min.Y), s}, nil
+	}
+
+	if !sameAspect(felt.Size(), refFelt.Size()) {
+		return Transform{}, fmt.Errorf("unsupported table, felt %v does not "+
+			"have the aspect ratio of %v", felt, refFelt)
+	}
+
+	sx := float64(felt.Dx()) / float64(refFelt.Dx())
+	sy := float64(felt.Dy()) / float64(refFelt.Dy())
+	s := (sx + sy) / 2
+	return Transform{
+		OffsetX: float64(felt.Min.X) - s*float64(refFelt.Min.X),
+		OffsetY: float64(felt.Min.Y) - s*float64(refFelt.Min.Y),
+		Scale:   s,
+	}, nil
+}
+
+const (
+	// plateSearch is how far, in pixels of the reference file, a seat plate
+	// is searched for around where the felt puts it.
+	plateSearch = 8
+	// plateDistance is the distance from the seat plate (see distance) below
+	// which a plate is found, and plateContrast how much farther the plate
+	// has to be when it is moved by a quarter of its size. Without the
+	// contrast, a plate in an area of its own color would be found anywhere.
+	plateDistance = 0.15
+	plateContrast = 0.1
+	// plateResidual is how far, in pixels of the reference file, a plate may
+	// be from where the fitted transform puts it.
+	plateResidual = 2
+)
+
+// anchors returns the centers of the seat plates in the coordinates of the
+// reference file. A plate is around the name and the stack of the seat.
+func (l *layout) anchors() []image.Point {
+	if l.refs == nil {
+		return nil
+	}
+	var ret []image.Point
+	for i := 0; i < l.seats; i++ {
+		name, ok := l.refs.regions[fmt.Sprintf("plName%v", i)]
+		stack, ok2 := l.refs.regions[fmt.Sprintf("plStack%v", i)]
+		if !ok || !ok2 {
+			continue
+		}
+		r := name.rect.Union(stack.rect)
+		ret = append(ret, image.Pt((r.Min.X+r.Max.X)/2, (r.Min.Y+r.Max.Y)/2))
+	}
+	return ret
+}
+
+// fitSeats returns the transform which puts the seat plates of the selected
+// layout where they are found in the image. The plates are searched for near
+// where tr puts them. With a single plate only the offset is corrected. If no
+// plate is found, or the plates do not agree, tr is returned.
+func (t *Table) fitSeats(img image.Image, tr Transform) Transform {
+	if seatPlate == nil {
+		return tr
+	}
+
+	var refs, found [][2]float64
+	for _, a := range t.layout.anchors() {
+		x, y := tr.Apply(float64(a.X), float64(a.Y))
+		if p, ok := findPlate(img, x, y, tr.Scale); ok {
+			refs = append(refs, [2]float64{float64(a.X), float64(a.Y)})
+			found = append(found, p)
+		}
+	}
+	if len(found) == 0 {
+		return tr
+	}
+
+	// Least squares fit of image = offset + scale*reference.
+	var mr, mf [2]float64
+	for i := range found {
+		for k := 0; k < 2; k++ {
+			mr[k] += refs[i][k] / float64(len(found))
+			mf[k] += found[i][k] / float64(len(found))
+		}
+	}
+	var cov, v float64
+	for i := range found {
+		for k := 0; k < 2; k++ {
+			cov += (refs[i][k] - mr[k]) * (found[i][k] - mf[k])
+			v += (refs[i][k] - mr[k]) * (refs[i][k] - mr[k])
+		}
+	}
+	s := tr.Scale
+	if len(found) > 1 && v > 0 {
+		s = cov / v
+	}
+	fit := Transform{mf[0] - s*mr[0], mf[1] - s*mr[1], s}
+
+	// Plates found in the wrong place, or a table which is not of the
+	// layout, do not fit.
+	if math.Abs(s/tr.Scale-1) > maxAspectDeviation {
+		return tr
+	}
+	for i := range found {
+		x, y := fit.Apply(refs[i][0], refs[i][1])
+		if math.Hypot(x-found[i][0], y-found[i][1]) > plateResidual*s {
+			return tr
+		}
+	}
+	return fit
+}
+
+// findPlate returns the center of the seat plate of a table of the given scale
+// which is closest to the seat plate, within plateSearch of x, y.
+func findPlate(img image.Image, x, y, scale float64) ([2]float64, bool) {
+	r := int(math.Ceil(plateSearch * scale))
+	best, bestX, bestY := 1.0, 0, 0
+	for dy := -r; dy <= r; dy++ {
+		for dx := -r; dx <= r; dx++ {
+			if d := plateAt(img, x+float64(dx), y+float64(dy), scale); d < best {
+				best, bestX, bestY = d, dx, dy
+			}
+		}
+	}
+	if best > plateDistance {
+		return [2]float64{}, false
+	}
+
+	cx, cy := x+float64(bestX), y+float64(bestY)
+	pb := seatPlate.Bounds()
+	qx, qy := scale*float64(pb.Dx())/4, scale*float64(pb.Dy())/4
+	for _, d := range [][2]float64{{-qx, 0}, {qx, 0}, {0, -qy}, {0, qy}} {
+		if plateAt(img, cx+d[0], cy+d[1], scale)-best < plateContrast {
+			return [2]float64{}, false
+		}
+	}
+	return [2]float64{cx, cy}, true
+}
+
+// plateAt returns how much the region of the image centered at x, y differs
+// from the seat plate at the given scale, from 0 (the same) to 1. Every other
+// pixel of the plate is compared, and the region has to lie in the image.
+func plateAt(img image.Image, x, y, scale float64) float64 {
+	b, pb := img.Bounds(), seatPlate.Bounds()
+
+	var sum, weight float64
+	for ry := pb.Min.Y; ry < pb.Max.Y; ry += 2 {
+		for rx := pb.Min.X; rx < pb.Max.X; rx += 2 {
+			c := color.NRGBAModel.Convert(seatPlate.At(rx, ry)).(color.NRGBA)
+			if c.A == 0 {
+				continue
+			}
+			// The pixel whose area holds the center of the plate pixel.
+			p := image.Pt(
+				int(math.Floor(x+scale*(float64(rx-pb.Min.X)+0.5-
+					float64(pb.Dx())/2))),
+				int(math.Floor(y+scale*(float64(ry-pb.Min.Y)+0.5-
+					float64(pb.Dy())/2))))
+			if !p.In(b) {
+				return 1
+			}
+			q := color.NRGBAModel.Convert(img.At(p.X, p.Y)).(color.NRGBA)
+
+			w := float64(c.A) / 255
+			sum += w * (math.Abs(float64(c.R)-float64(q.R)) +
+				math.Abs(float64(c.G)-float64(q.G)) +
+				math.Abs(float64(c.B)-float64(q.B))) / (3 * 255)
+			weight += w
+		}
+	}
+	if weight == 0 {
+		return 1
+	}
+	return sum / weight
+}
+
+// sameAspect returns whether two sizes have the same aspect ratio.
+func sameAspect(a, b image.Point) bool {
+	ra := float64(a.X) / float64(a.Y)
+	rb := float64(b.X) / float64(b.Y)
+	return math.Abs(ra/rb-1) <= maxAspectDeviation
+}
+
+// feltTolerance is how much the color of a pixel of the felt may differ from
+// the color of the felt (sum of the differences of red, green and blue).
+const feltTolerance = 40
+
+// findFelt returns the rectangle around the felt in the image. The color of
+// the felt is the most common color in the middle of the image, as the felt
+// changes with the theme.
+func findFelt(img image.Image) (image.Rectangle, bool) {
+	b := img.Bounds()
+	if b.Dx() < 3 || b.Dy() < 3 {
+		return image.Rectangle{}, false
+	}
+
+	// Most common color in the middle, with the lowest bits ignored.
+	hist := make(map[color.RGBA]int)
+	mid := image.Rect(b.Min.X+b.Dx()/3, b.Min.Y+b.Dy()/3,
+		b.Max.X-b.Dx()/3, b.Max.Y-b.Dy()/3)
+	for y := mid.Min.Y; y < mid.Max.Y; y++ {
+		for x := mid.Min.X; x < mid.Max.X; x++ {
+			c := color.RGBAModel.Convert(img.At(x, y)).(color.RGBA)
+			c.R, c.G, c.B = c.R&^7, c.G&^7, c.B&^7
+			hist[c]++
+		}
+	}
+	var felt color.RGBA
+	n := 0
+	for c, k := range hist {
+		if k > n {
+			felt, n = c, k
+		}
+	}
+
+	// The felt covers most of the middle of the table, and it is not gray
+	// like the background around the table.
+	if n < mid.Dx()*mid.Dy()/4 || (felt.R == felt.G && felt.G == felt.B) {
+		return image.Rectangle{}, false
+	}
+
+	diff := func(a, b uint8) int {
+		if a > b {
+			return int(a - b)
+		}
+		return int(b - a)
+	}
+	rows := make([]int, b.Dy())
+	cols := make([]int, b.Dx())
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			c := color.RGBAModel.Convert(img.At(x, y)).(color.RGBA)
+			if diff(c.R, felt.R)+diff(c.G, felt.G)+diff(c.B, felt.B) < feltTolerance {
+				rows[y-b.Min.Y]++
+				cols[x-b.Min.X]++
+			}
+		}
+	}
+
+	// Single pixels of the color of the felt elsewhere are ignored.
+	min, max := span(rows, b.Dx()/50)
+	r := image.Rect(0, b.Min.Y+min, 0, b.Min.Y+max)
+	min, max = span(cols, b.Dy()/50)
+	r.Min.X, r.Max.X = b.Min.X+min, b.Min.X+max
+
+	if r.Dx() < b.Dx()/4 || r.Dy() < b.Dy()/4 {
+		return image.Rectangle{}, false
+	}
+	return r, true
+}
+
+// span returns the first index of counts with at least min, and the index
+// after the last one.
+func span(counts []int, min int) (int, int) {
+	first, last := 0, -1
+	for i, c := range counts {
+		if c >= min && c > 0 {
+			if last < 0 {
+				first = i
+			}
+			last = i
+		}
+	}
+	return first, last + 1
+}
+
+// WriteLayout writes the reference file of the selected layout with all
+// regions transformed to the coordinates of an image of the given size. This
+// is the reference file of a table as it is on this machine.
+func (t *Table) WriteLayout(w io.Writer, tr Transform, size image.Point) error {
+	r, err := load(t.layout.file)
+	if err != nil {
+		return err
+	}
+
+	var refs map[string]interface{}
+	if err := json.NewDecoder(r).Decode(&refs); err != nil {
+		return err
+	}
+
+	// transform returns the rectangle (or point) x, y[, width, height] in
+	// image coordinates.
+	transform := func(src []interface{}) []int {
+		ret := make([]int, len(src))
+		for i, v := range src {
+			f, _ := v.(float64)
+			switch i {
+			case 0:
+				f, _ = tr.Apply(f, 0)
+			case 1:
+				_, f = tr.Apply(0, f)
+			default:
+				f *= tr.Scale
+			}
+			ret[i] = int(math.Floor(f + 0.5))
+		}
+		return ret
+	}
+
+	srcs, _ := refs["Srcs"].([]interface{})
+	for _, s := range srcs {
+		src, ok := s.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if rect, ok := src["Src"].([]interface{}); ok {
+			src["Src"] = transform(rect)
+		}
+	}
+	refs["Size"] = []int{size.X, size.Y}
+	if felt, ok := refs["Felt"].([]interface{}); ok {
+		refs["Felt"] = transform(felt)
+	}
+
+	b, err := json.MarshalIndent(refs, "", "\t")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(b, '\n'))
+	return err
+}
@@ -0,0 +1,138 @@
+package vision
+
+import (
+	"bytes"
+	"encoding/json"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"io"
+	"math"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// TestDetectFrame verifies that the table is found in a screenshot of a
+// smaller table which includes the window border and title bar.
+func TestDetectFrame(t *testing.T) {
+	tb := &Table{layout: &layout{
+		size: image.Pt(792, 546),
+		felt: image.Rect(118, 110, 118+557, 110+244),
+	}}
+
+	f, err := os.Open("../res/testdata/players.png")
+	if err != nil {
+		t.Fatalf("Failed to open image file: %v", err)
+	}
+	img, err := png.Decode(f)
+	f.Close()
+	if err != nil {
+		t.Fatalf("Failed to decode image file: %v", err)
+	}
+
+	// The table is 640 pixels wide, below a border of 1 pixel and a title
+	// bar of 22 pixels.
+	tr, err := tb.DetectFrame(img)
+	if err != nil {
+		t.Fatalf("Failed to detect frame: %v", err)
+	}
+	if math.Abs(tr.OffsetX-1) > 1.5 || math.Abs(tr.OffsetY-23) > 1.5 ||
+		math.Abs(tr.Scale-640.0/792) > 0.005 {
+		t.Errorf("Expected offset (1, 23), scale %.4f, got %v", 640.0/792, tr)
+	}
+}
+
+// stringLoader loads every file from the same string.
+type stringLoader string
+
+func (l stringLoader) Load(string) io.Reader {
+	return strings.NewReader(string(l))
+}
+
+// TestWriteLayout verifies that regions are written in image coordinates.
+func TestWriteLayout(t *testing.T) {
+	loader = stringLoader(`{"Size":[792,546],"Felt":[118,110,557,244],` +
+		`"Srcs":[{"Name":"pot","Src":[352,42,101,19],"Refs":["potOCR"]},` +
+		`{"Name":"button0","Src":[488,115],"Refs":["button"]}]}`)
+	defer func() { loader = nil }()
+	tb := &Table{layout: &layout{seats: 6, file: "refs.json"}}
+
+	var buf bytes.Buffer
+	tr := Transform{OffsetX: 1, OffsetY: 23, Scale: 0.5}
+	if err := tb.WriteLayout(&buf, tr, image.Pt(397, 296)); err != nil {
+		t.Fatalf("Failed to write layout: %v", err)
+	}
+
+	var got struct {
+		Size []int
+		Felt []int
+		Srcs []struct {
+			Name string
+			Src  []int
+		}
+	}
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatalf("Failed to read layout: %v", err)
+	}
+
+	expected := map[string][]int{
+		"pot":     {177, 44, 51, 10},
+		"button0": {245, 81},
+	}
+	for _, s := range got.Srcs {
+		if !reflect.DeepEqual(s.Src, expected[s.Name]) {
+			t.Errorf("%v: Expected %v, got %v", s.Name, expected[s.Name], s.Src)
+		}
+	}
+	if !reflect.DeepEqual(got.Size, []int{397, 296}) {
+		t.Errorf("Expected size [397 296], got %v", got.Size)
+	}
+	if !reflect.DeepEqual(got.Felt, []int{60, 78, 279, 122}) {
+		t.Errorf("Expected felt [60 78 279 122], got %v", got.Felt)
+	}
+}
+
+// TestFitSeats verifies that the transform is corrected by the seat plates
+// found in the image, and kept when there are none.
+func TestFitSeats(t *testing.T) {
+	defer func(p image.Image) { seatPlate = p }(seatPlate)
+	seatPlate = image.NewRGBA(image.Rect(0, 0, 20, 10))
+	draw.Draw(seatPlate.(draw.Image), seatPlate.Bounds(),
+		image.NewUniform(color.Black), image.ZP, draw.Src)
+
+	tb := &Table{layout: &layout{seats: 2, refs: &references{
+		regions: map[string]region{
+			"plName0":  {rect: image.Rect(20, 20, 40, 25)},
+			"plStack0": {rect: image.Rect(20, 25, 40, 30)},
+			"plName1":  {rect: image.Rect(120, 60, 140, 65)},
+			"plStack1": {rect: image.Rect(120, 65, 140, 70)},
+		},
+	}}}
+
+	// The plates are 3 pixels to the right of and 2 pixels below where the
+	// transform puts them.
+	img := image.NewRGBA(image.Rect(0, 0, 200, 100))
+	draw.Draw(img, img.Bounds(), image.NewUniform(color.White), image.ZP,
+		draw.Src)
+	for _, r := range []image.Rectangle{
+		image.Rect(23, 22, 43, 32), image.Rect(123, 62, 143, 72),
+	} {
+		draw.Draw(img, r, image.NewUniform(color.Black), image.ZP, draw.Src)
+	}
+
+	if tr := tb.fitSeats(img, identity); math.Abs(tr.OffsetX-3) > 0.5 ||
+		math.Abs(tr.OffsetY-2) > 0.5 || math.Abs(tr.Scale-1) > 0.01 {
+		t.Errorf("Expected offset (3, 2), scale 1, got %v", tr)
+	}
+
+	// Without plates, and on a plain table, nothing is corrected.
+	for _, c := range []color.Color{color.White, color.Black} {
+		draw.Draw(img, img.Bounds(), image.NewUniform(c), image.ZP, draw.Src)
+		if tr := tb.fitSeats(img, identity); tr != identity {
+			t.Errorf("Expected no correction on %v, got %v", c, tr)
+		}
+	}
+}
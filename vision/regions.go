@@ -0,0 +1,66 @@
+package vision
+
+import (
+	"fmt"
+	"hash/fnv"
+	"image"
+	"strings"
+)
+
+// RegionHashes returns a hash of the pixels of each region of the selected
+// layout whose name starts with one of the prefixes, e.g. "plBet", or of all
+// regions if there are no prefixes. A region looks the same in two images of
+// the table if its hashes are equal.
+func (t *Table) RegionHashes(img image.Image, prefixes []string) (map[string]uint64, error) {
+	if t.layout.refs == nil {
+		return nil, fmt.Errorf("no regions for %v-max tables", t.layout.seats)
+	}
+	img, err := t.scale(img)
+	if err != nil {
+		return nil, err
+	}
+	return regionHashes(img, t.layout.refs.regions, prefixes), nil
+}
+
+// regionHashes returns the hashes of the regions of a scaled image whose
+// names start with one of the prefixes.
+func regionHashes(img image.Image, regions map[string]region,
+	prefixes []string) map[string]uint64 {
+
+	ret := make(map[string]uint64)
+	for name, reg := range regions {
+		if !hasPrefix(name, prefixes) {
+			continue
+		}
+
+		h := fnv.New64a()
+		buf := make([]byte, 8)
+		rect := reg.rect.Intersect(img.Bounds())
+		for y := rect.Min.Y; y < rect.Max.Y; y++ {
+			for x := rect.Min.X; x < rect.Max.X; x++ {
+				r, g, b, a := img.At(x, y).RGBA()
+				buf[0], buf[1] = byte(r>>8), byte(r)
+				buf[2], buf[3] = byte(g>>8), byte(g)
+				buf[4], buf[5] = byte(b>>8), byte(b)
+				buf[6], buf[7] = byte(a>>8), byte(a)
+				h.Write(buf)
+			}
+		}
+		ret[name] = h.Sum64()
+	}
+	return ret
+}
+
+// hasPrefix returns whether s starts with one of the prefixes, or whether
+// there are none.
+func hasPrefix(s string, prefixes []string) bool {
+	if len(prefixes) == 0 {
+		return true
+	}
+	for _, p := range prefixes {
+		if strings.HasPrefix(s, p) {
+			return true
+		}
+	}
+	return false
+}
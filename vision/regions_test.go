@@ -0,0 +1,35 @@
+package vision
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+// TestRegionHashes verifies that only the regions whose pixels changed hash
+// differently, and that regions are selected by prefix.
+func TestRegionHashes(t *testing.T) {
+	regions := map[string]region{
+		"pot":    {rect: image.Rect(0, 0, 4, 4)},
+		"plBet0": {rect: image.Rect(4, 0, 8, 4)},
+		"plBet1": {rect: image.Rect(0, 4, 4, 8)},
+	}
+	img := image.NewRGBA(image.Rect(0, 0, 8, 8))
+	before := regionHashes(img, regions, nil)
+	img.Set(5, 1, color.RGBA{255, 0, 0, 255})
+	after := regionHashes(img, regions, nil)
+
+	if len(before) != 3 || len(after) != 3 {
+		t.Fatalf("Expected 3 regions, got %v and %v", len(before), len(after))
+	}
+	for name := range regions {
+		if changed := before[name] != after[name]; changed != (name == "plBet0") {
+			t.Errorf("%v: Unexpected change %v", name, changed)
+		}
+	}
+
+	bets := regionHashes(img, regions, []string{"plBet"})
+	if _, ok := bets["pot"]; ok || len(bets) != 2 {
+		t.Errorf("Expected the bets only, got %v", bets)
+	}
+}
@@ -0,0 +1,155 @@
+package vision
+
+import (
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"math"
+
+	"github.com/whomever000/poker-vision"
+)
+
+// The regions in the reference files are given in the coordinates of a table
+// of the size in the "Size" field of the file. Images are transformed to that
+// size before matching, which is the same as transforming the regions and the
+// reference images to the table (see frame.go).
+
+// maxAspectDeviation is how much the aspect ratio of a table may differ from
+// the one of the reference files. PokerStars keeps the aspect ratio when a
+// table is resized, so anything beyond this is not a table.
+const maxAspectDeviation = 0.03
+
+var loader pokervision.FileLoader
+
+// SetFileLoader sets the loader of the reference files.
+func SetFileLoader(l pokervision.FileLoader) {
+	loader = l
+	pokervision.SetFileLoader(l)
+}
+
+// layoutFile are the fields of a reference file which vision uses itself.
+type layoutFile struct {
+	// Size is the width and height of the table the file was made for.
+	Size []int
+	// Felt is the rectangle x, y, width, height around the felt.
+	Felt []int
+}
+
+// load opens a file through the file loader.
+func load(file string) (io.Reader, error) {
+	var r io.Reader
+	if loader != nil {
+		r = loader.Load(file)
+	}
+	if r == nil {
+		return nil, fmt.Errorf("failed to open %v", file)
+	}
+	return r, nil
+}
+
+// readLayout reads the table size and felt of a reference file.
+func readLayout(file string) (size image.Point, felt image.Rectangle, err error) {
+	r, err := load(file)
+	if err != nil {
+		return size, felt, err
+	}
+
+	var l layoutFile
+	if err := json.NewDecoder(r).Decode(&l); err != nil {
+		return size, felt, err
+	}
+	if len(l.Size) != 2 || l.Size[0] <= 0 || l.Size[1] <= 0 {
+		return size, felt, fmt.Errorf("%v has no valid table size", file)
+	}
+	if len(l.Felt) != 4 || l.Felt[2] <= 0 || l.Felt[3] <= 0 {
+		return size, felt, fmt.Errorf("%v has no valid felt", file)
+	}
+
+	size = image.Pt(l.Size[0], l.Size[1])
+	felt = image.Rect(l.Felt[0], l.Felt[1], l.Felt[0]+l.Felt[2],
+		l.Felt[1]+l.Felt[3])
+	return size, felt, nil
+}
+
+// scaledCache is the last scaled image of a table, as all regions of the same
+// image are read one after another.
+type scaledCache struct {
+	layout   *layout
+	src, dst image.Image
+}
+
+// scale returns the image transformed to the coordinates of the selected
+// layout. It fails if the table in the image cannot be transformed.
+func (t *Table) scale(img image.Image) (image.Image, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if img == t.scaled.src && t.layout == t.scaled.layout {
+		return t.scaled.dst, nil
+	}
+
+	tr, err := t.detectFrame(img)
+	if err != nil {
+		return nil, err
+	}
+	size := t.layout.size
+	dst := img
+	if tr != identity || img.Bounds() != image.Rect(0, 0, size.X, size.Y) {
+		dst = warp(img, tr, size)
+	}
+
+	t.scaled = scaledCache{t.layout, img, dst}
+	return dst, nil
+}
+
+// warp returns the image of the given size whose pixels are those of src at
+// the transformed coordinates, using bilinear interpolation.
+func warp(src image.Image, t Transform, size image.Point) image.Image {
+	b := src.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, size.X, size.Y))
+
+	// clamp returns the pixels around f, which lies within [0, n), and the
+	// weight of the second one.
+	clamp := func(f float64, n int) (int, int, float64) {
+		f = math.Min(math.Max(f, 0), float64(n-1))
+		i := int(f)
+		return i, minInt(i+1, n-1), f - float64(i)
+	}
+
+	for y := 0; y < size.Y; y++ {
+		fy := t.OffsetY + t.Scale*(float64(y)+0.5) - 0.5
+		y0, y1, wy := clamp(fy-float64(b.Min.Y), b.Dy())
+
+		for x := 0; x < size.X; x++ {
+			fx := t.OffsetX + t.Scale*(float64(x)+0.5) - 0.5
+			x0, x1, wx := clamp(fx-float64(b.Min.X), b.Dx())
+
+			c00 := color.RGBAModel.Convert(src.At(b.Min.X+x0, b.Min.Y+y0)).(color.RGBA)
+			c10 := color.RGBAModel.Convert(src.At(b.Min.X+x1, b.Min.Y+y0)).(color.RGBA)
+			c01 := color.RGBAModel.Convert(src.At(b.Min.X+x0, b.Min.Y+y1)).(color.RGBA)
+			c11 := color.RGBAModel.Convert(src.At(b.Min.X+x1, b.Min.Y+y1)).(color.RGBA)
+
+			mix := func(v00, v10, v01, v11 uint8) uint8 {
+				top := float64(v00)*(1-wx) + float64(v10)*wx
+				bot := float64(v01)*(1-wx) + float64(v11)*wx
+				return uint8(top*(1-wy) + bot*wy + 0.5)
+			}
+			dst.SetRGBA(x, y, color.RGBA{
+				mix(c00.R, c10.R, c01.R, c11.R),
+				mix(c00.G, c10.G, c01.G, c11.G),
+				mix(c00.B, c10.B, c01.B, c11.B),
+				mix(c00.A, c10.A, c01.A, c11.A),
+			})
+		}
+	}
+	return dst
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
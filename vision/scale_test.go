@@ -0,0 +1,69 @@
+package vision
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+// TestScale verifies that images are scaled to the reference size and that
+// images of another aspect ratio are rejected.
+func TestScale(t *testing.T) {
+	tb := &Table{layout: &layout{size: image.Pt(792, 546)}}
+
+	tests := []struct {
+		name string
+		size image.Point
+		ok   bool
+	}{
+		{"same", image.Pt(792, 546), true},
+		{"larger", image.Pt(1188, 819), true},
+		{"smaller", image.Pt(640, 441), true},
+		{"wide", image.Pt(1000, 546), false},
+		{"tall", image.Pt(792, 792), false},
+	}
+
+	for _, test := range tests {
+		img := image.NewRGBA(image.Rect(0, 0, test.size.X, test.size.Y))
+		got, err := tb.scale(img)
+		if !test.ok {
+			if err == nil {
+				t.Errorf("%v: Expected an error", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: Failed to scale: %v", test.name, err)
+			continue
+		}
+		if got.Bounds().Size() != tb.layout.size {
+			t.Errorf("%v: Expected size %v, got %v", test.name, tb.layout.size,
+				got.Bounds().Size())
+		}
+	}
+}
+
+// TestWarp verifies that warping keeps the colors of uniform areas.
+func TestWarp(t *testing.T) {
+	src := image.NewRGBA(image.Rect(10, 10, 30, 20))
+	red := color.RGBA{255, 0, 0, 255}
+	blue := color.RGBA{0, 0, 255, 255}
+	for y := 10; y < 20; y++ {
+		for x := 10; x < 30; x++ {
+			if x < 20 {
+				src.Set(x, y, red)
+			} else {
+				src.Set(x, y, blue)
+			}
+		}
+	}
+
+	dst := warp(src, Transform{OffsetX: 10, OffsetY: 10, Scale: 0.5},
+		image.Pt(40, 20))
+	if c := dst.At(5, 10); c != red {
+		t.Errorf("Expected %v on the left, got %v", red, c)
+	}
+	if c := dst.At(35, 10); c != blue {
+		t.Errorf("Expected %v on the right, got %v", blue, c)
+	}
+}
@@ -0,0 +1,132 @@
+package vision
+
+import (
+	"fmt"
+	"image"
+	"strings"
+
+	"github.com/whomever000/poker-common"
+)
+
+// SeatStatus is the state of a seat, as shown by the name and the stack of
+// the seat.
+type SeatStatus int
+
+// The states of a seat. A player who is active takes part in the game, which
+// does not mean they were dealt in. A disconnected player is also one who
+// plays on their time bank.
+const (
+	SeatEmpty SeatStatus = iota
+	SeatReserved
+	SeatSittingOut
+	SeatActive
+	SeatAllIn
+	SeatDisconnected
+)
+
+var seatStatusNames = []string{"empty", "reserved", "sitting out", "active",
+	"all-in", "disconnected"}
+
+func (s SeatStatus) String() string {
+	if s < 0 || int(s) >= len(seatStatusNames) {
+		return fmt.Sprintf("SeatStatus(%d)", int(s))
+	}
+	return seatStatusNames[s]
+}
+
+// Occupied returns whether a player sits at the seat.
+func (s SeatStatus) Occupied() bool {
+	return s != SeatEmpty && s != SeatReserved
+}
+
+// seatTexts are the texts PokerStars shows instead of a name or a stack, in
+// lower case and without spaces.
+var seatTexts = map[string]SeatStatus{
+	"emptyseat":    SeatEmpty,
+	"seatopen":     SeatEmpty,
+	"reserved":     SeatReserved,
+	"sittingout":   SeatSittingOut,
+	"sitout":       SeatSittingOut,
+	"allin":        SeatAllIn,
+	"disconnected": SeatDisconnected,
+	"timebank":     SeatDisconnected,
+}
+
+// Seat is what a seat shows: its state and the player sitting at it.
+type Seat struct {
+	Status SeatStatus
+	Name   string
+	// Stack is the stack of an active player. Players in other states show
+	// no stack, theirs is 0.
+	Stack poker.Amount
+
+	StatusConfidence Confidence
+	NameConfidence   Confidence
+	StackConfidence  Confidence
+}
+
+// Seat returns the state of a seat and the name and stack of its player. The
+// name and stack regions are read once for all of them.
+func (t *Table) Seat(img image.Image, position poker.PlayerPosition) (Seat, error) {
+
+	if position < 1 || int(position) > t.layout.seats {
+		return Seat{}, fmt.Errorf("Invalid player: %v", int(position))
+	}
+	img, err := t.scale(img)
+	if err != nil {
+		return Seat{}, err
+	}
+
+	n := fmt.Sprintf("plName%v", int(position)-1)
+	s := fmt.Sprintf("plStack%v", int(position)-1)
+	name := t.layout.m.Match(n, img)
+	stack := t.layout.m.Match(s, img)
+	t.debug(img, n, s)
+
+	ret := Seat{StackConfidence: 1}
+	ret.Status, ret.StatusConfidence = seatStatus(name, stack)
+	if !ret.Status.Occupied() {
+		return ret, nil
+	}
+	ret.Name, ret.NameConfidence = name, textConfidence(name)
+	if ret.Status == SeatActive {
+		// A stack which cannot be read is 0 and uncertain.
+		if ret.Stack, ret.StackConfidence, err = parseStack(stack); err != nil {
+			ret.Stack = 0
+		}
+	}
+	return ret, nil
+}
+
+// SeatStatus returns the state of a seat.
+func (t *Table) SeatStatus(img image.Image, position poker.PlayerPosition) (SeatStatus, Confidence, error) {
+	seat, err := t.Seat(img, position)
+	return seat.Status, seat.StatusConfidence, err
+}
+
+// seatStatus returns the state of a seat from the texts read in its name and
+// stack regions.
+func seatStatus(name, stack string) (SeatStatus, Confidence) {
+	key := func(s string) string {
+		return strings.ToLower(strings.Replace(s, " ", "", -1))
+	}
+
+	if status, ok := seatTexts[key(name)]; ok {
+		return status, 1
+	}
+	if status, ok := seatTexts[key(stack)]; ok {
+		return status, textConfidence(name)
+	}
+
+	switch {
+	case name == "" && stack == "":
+		return SeatEmpty, 1
+	case name == "":
+		// A stack without a name is a name which was not read.
+		return SeatActive, 0
+	}
+
+	_, err := poker.ParseAmount(strings.Replace(stack, "L", "1.", -1))
+	return SeatActive, minConfidence(textConfidence(name),
+		amountConfidence(err, false))
+}
@@ -0,0 +1,87 @@
+package vision
+
+import (
+	"image"
+	"testing"
+
+	"github.com/whomever000/poker-common"
+)
+
+// TestSeatStatus verifies the classification of seats by the texts in their
+// name and stack regions.
+func TestSeatStatus(t *testing.T) {
+	tests := []struct {
+		name, stack string
+		status      SeatStatus
+		certain     bool
+	}{
+		{"", "", SeatEmpty, true},
+		{"Empty Seat", "", SeatEmpty, true},
+		{"Reserved", "", SeatReserved, true},
+		{"alice", "Sitting Out", SeatSittingOut, true},
+		{"alice", "AllIn", SeatAllIn, true},
+		{"alice", "Disconnected", SeatDisconnected, true},
+		{"alice", "Time Bank", SeatDisconnected, true},
+		{"alice", "1.50", SeatActive, true},
+		{"alice", "l.5x", SeatActive, false},
+		{"", "1.50", SeatActive, false},
+	}
+
+	for _, test := range tests {
+		status, c := seatStatus(test.name, test.stack)
+		if status != test.status || c.Uncertain() == test.certain {
+			t.Errorf("%q/%q: Expected %v (certain %v), got %v (confidence %v)",
+				test.name, test.stack, test.status, test.certain, status, c)
+		}
+	}
+}
+
+// textMatcher reads the texts it holds in their regions.
+type textMatcher map[string]string
+
+func (m textMatcher) Match(src string, img image.Image) string {
+	return m[src]
+}
+
+func (m textMatcher) VisualizeSource(img image.Image, srcs []string) image.Image {
+	return img
+}
+
+// TestSeat verifies that only the stacks of active players are read, and
+// that the stacks players in other states do not show are certain.
+func TestSeat(t *testing.T) {
+	stack, err := poker.ParseAmount("1.50")
+	if err != nil {
+		t.Fatalf("Failed to parse amount: %v", err)
+	}
+
+	tests := []struct {
+		name, stack string
+		seat        Seat
+	}{
+		{"", "", Seat{Status: SeatEmpty}},
+		{"alice", "1.50", Seat{Status: SeatActive, Name: "alice",
+			Stack: stack}},
+		{"alice", "Sitting Out", Seat{Status: SeatSittingOut, Name: "alice"}},
+		{"alice", "AllIn", Seat{Status: SeatAllIn, Name: "alice"}},
+	}
+
+	size := image.Pt(80, 60)
+	img := image.NewRGBA(image.Rect(0, 0, size.X, size.Y))
+	for _, test := range tests {
+		tb := &Table{layout: &layout{seats: 2, size: size, m: textMatcher{
+			"plName1": test.name, "plStack1": test.stack}}}
+
+		seat, err := tb.Seat(img, 2)
+		if err != nil {
+			t.Errorf("%q/%q: Failed to read seat: %v", test.name, test.stack,
+				err)
+			continue
+		}
+		if seat.Status != test.seat.Status || seat.Name != test.seat.Name ||
+			seat.Stack != test.seat.Stack || seat.StackConfidence.Uncertain() {
+			t.Errorf("%q/%q: Expected %+v, got %+v", test.name, test.stack,
+				test.seat, seat)
+		}
+	}
+}
@@ -1,11 +1,13 @@
 package vision
 
 import (
+	"errors"
 	"fmt"
 	"image"
-	"log"
+	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/whomever000/poker-common"
 	"github.com/whomever000/poker-common/card"
@@ -13,194 +15,575 @@ import (
 	"github.com/whomever000/poker-vision"
 )
 
-var img image.Image
-
-func SetImage(i image.Image) {
-	img = i
-}
-func Image() image.Image {
-	return img
-}
-
+// ImageSource is where the images of a table come from.
 type ImageSource interface {
-	Get() image.Image
+	// Get returns the next image. It returns ErrEndOfStream once there are
+	// no more images, or another error if the next image could not be
+	// taken. A source may have more images after other errors.
+	Get() (image.Image, error)
 }
 
+// ErrEndOfStream is the error returned by ImageSource.Get once a source has
+// no more images.
+var ErrEndOfStream = errors.New("end of image stream")
+
 type DefaultImageSource struct {
 }
 
 func NewDefaultImageSource() ImageSource {
 	return &DefaultImageSource{}
 }
-func (dis *DefaultImageSource) Get() image.Image {
-	var err error
-	img, err = window.Get().Image()
+func (dis *DefaultImageSource) Get() (image.Image, error) {
+	img, err := window.Get().Image()
 	if err != nil {
-		panic("Could not get image from window")
+		return nil, fmt.Errorf("could not get image from window. %v", err)
 	}
-	return img
+	return img, nil
 }
 
-func VisualizeSource(img image.Image, srcs []string) image.Image {
-	return m.VisualizeSource(img, srcs)
+// WindowImageSource is an image source which captures a window.
+type WindowImageSource struct {
+	win window.Window
 }
 
-var m pokervision.Matcher
+// NewWindowImageSource creates an image source which captures the given
+// window.
+func NewWindowImageSource(win window.Window) ImageSource {
+	return &WindowImageSource{win: win}
+}
 
-// LoadReferences loads the reference file.
-func LoadReferences() error {
+// Get captures the window. The window may fail to be captured, e.g. because
+// it is being closed.
+func (wis *WindowImageSource) Get() (image.Image, error) {
+	img, err := wis.win.Image()
+	if err != nil {
+		return nil, fmt.Errorf("failed to capture window. %v", err)
+	}
+	return img, nil
+}
 
-	var err error
-	m, err = pokervision.NewMatcher("./references/refs.json")
+// VisualizeSource returns the image of the table with the given regions
+// marked.
+func (t *Table) VisualizeSource(img image.Image, srcs []string) (image.Image, error) {
+	img, err := t.scale(img)
+	if err != nil {
+		return nil, err
+	}
+	return t.layout.m.VisualizeSource(img, srcs), nil
+}
 
+// Check returns an error if the table in the image cannot be read with the
+// selected layout, e.g. because the window has another aspect ratio.
+func (t *Table) Check(img image.Image) error {
+	_, err := t.scale(img)
 	return err
 }
 
+// debug shows the regions of a scaled image in a debug image.
+func (t *Table) debug(img image.Image, srcs ...string) {
+	if t.Debug {
+		window.DebugImage(t.layout.m.VisualizeSource(img, srcs), "vision")
+	}
+}
+
+// layout is the reference file of one table size.
+type layout struct {
+	seats int
+	file  string
+	m     pokervision.Matcher
+	size  image.Point
+	felt  image.Rectangle
+	refs  *references
+}
+
+// layouts are the supported table sizes. The 2-max and 9-max layouts are
+// derived from the 6-max table and still need tuning against screenshots of
+// real tables (see the accuracy command). So do the regions of the cards
+// shown at showdown, which are placed next to the names like the calibrated
+// pocket regions of the first seat and are where our own hole cards are read
+// from at the other seats, and the regions of the bets, which are placed
+// between the seats and the middle of the felt.
+var layouts = []*layout{
+	{seats: 2, file: "./references/refs2max.json"},
+	{seats: 6, file: "./references/refs.json"},
+	{seats: 9, file: "./references/refs9max.json"},
+}
+
+// LoadReferences loads the reference files of all layouts and the seat plate
+// of the theme. They are shared by all tables.
+func LoadReferences() error {
+
+	for _, l := range layouts {
+		var err error
+		l.m, err = pokervision.NewMatcher(l.file)
+		if err != nil {
+			return fmt.Errorf("failed to load %v. %v", l.file, err)
+		}
+		l.size, l.felt, err = readLayout(l.file)
+		if err != nil {
+			return fmt.Errorf("failed to load %v. %v", l.file, err)
+		}
+		l.refs, err = readReferences(l.file)
+		if err != nil {
+			return fmt.Errorf("failed to load %v. %v", l.file, err)
+		}
+	}
+	return loadSeatPlate()
+}
+
+// Table is the state of a single table: its layout, its current image and
+// what the image was scaled to. The layouts are shared by all tables and do
+// not change after LoadReferences, so tables can be read concurrently.
+type Table struct {
+	// Debug shows the regions which are read in debug images.
+	Debug bool
+
+	layout *layout
+	img    image.Image
+
+	// Guards the caches of scale.go and frame.go, as the regions of an image
+	// may be read concurrently.
+	mu     sync.Mutex
+	scaled scaledCache
+	frame  frameCache
+}
+
+// NewTable creates a table with the 6-max layout.
+func NewTable() *Table {
+	t := &Table{}
+	if err := t.SetLayout(6); err != nil {
+		panic(err)
+	}
+	return t
+}
+
+// SetLayout selects the layout of tables with the given number of seats.
+func (t *Table) SetLayout(numSeats int) error {
+	for _, l := range layouts {
+		if l.seats == numSeats {
+			t.layout = l
+			return nil
+		}
+	}
+	return fmt.Errorf("no layout for %v-max tables", numSeats)
+}
+
+// Seats returns the number of seats of the selected layout.
+func (t *Table) Seats() int {
+	return t.layout.seats
+}
+
+// SetImage sets the current image of the table.
+func (t *Table) SetImage(img image.Image) {
+	t.img = img
+}
+
+// Image returns the current image of the table.
+func (t *Table) Image() image.Image {
+	return t.img
+}
+
+// reSeats matches the table size in a window name, e.g. "6-max".
+var reSeats = regexp.MustCompile(`(?i)\b(\d+)-max\b|\b(heads[ -]?up)\b`)
+
+// SeatsFromName returns the table size given in a window name, or 0 if it
+// does not give one.
+func SeatsFromName(name string) int {
+	match := reSeats.FindStringSubmatch(name)
+	switch {
+	case match == nil:
+		return 0
+	case match[2] != "":
+		return 2
+	}
+	size, _ := strconv.Atoi(match[1])
+	return size
+}
+
+// DetectSeats returns the number of seats of the table in the image. This is
+// the size of the layout which reads a name at most of its seats. Of layouts
+// which read as many names the larger one is taken, as a smaller layout may
+// share seats with it. It fails if no layout reads a name. The selected
+// layout does not change.
+func DetectSeats(img image.Image) (int, error) {
+	best, bestNames := 0, 0
+	var scaleErr error
+	for _, l := range layouts {
+		img, err := (&Table{layout: l}).scale(img)
+		if err != nil {
+			scaleErr = err
+			continue
+		}
+
+		names := 0
+		for i := 0; i < l.seats; i++ {
+			if len(l.m.Match(fmt.Sprintf("plName%v", i), img)) != 0 {
+				names++
+			}
+		}
+		if names > bestNames || names > 0 && names == bestNames &&
+			l.seats > best {
+			best, bestNames = l.seats, names
+		}
+	}
+
+	switch {
+	case best != 0:
+		return best, nil
+	case scaleErr != nil:
+		return 0, scaleErr
+	}
+	return 0, fmt.Errorf("no player names found at the table")
+}
+
 // Pot returns the current pot.
-func Pot(img image.Image) (poker.Amount, error) {
-	pot := m.Match("pot", img)
-	window.DebugImage(VisualizeSource(img, []string{"pot"}), "vision")
+func (t *Table) Pot(img image.Image) (poker.Amount, Confidence, error) {
+	img, err := t.scale(img)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	pot := t.layout.m.Match("pot", img)
+	t.debug(img, "pot")
 
 	// The string includes 'Pot:', so remove this before parsing.
 	pot = strings.ToLower(pot)
 	pot = strings.Replace(pot, "pot:", "", -1)
 	pot = strings.Replace(pot, " ", "", -1)
+	read := pot
 	pot = strings.Replace(pot, "L", "1.", -1)
 	pot = strings.Replace(pot, "S", "5.", -1)
+	corrected := pot != read
 
 	if len(pot) == 0 {
-		return 0, fmt.Errorf("Failed to get pot, got empty string")
+		return 0, 0, fmt.Errorf("Failed to get pot, got empty string")
 	}
 
 	// Remote '$' as it may be misinterpreted by OCR.
 	pot = pot[1:]
 
-	return poker.ParseAmount(pot)
+	amount, err := poker.ParseAmount(pot)
+	return amount, amountConfidence(err, corrected), err
 }
 
 // PlayerStack returns a player's stack.
-func PlayerStack(img image.Image, position poker.PlayerPosition) (poker.Amount, error) {
+func (t *Table) PlayerStack(img image.Image, position poker.PlayerPosition) (poker.Amount, Confidence, error) {
 
-	if position < 1 {
-		return 0, fmt.Errorf("Invalid player: %v", int(position))
+	if position < 1 || int(position) > t.layout.seats {
+		return 0, 0, fmt.Errorf("Invalid player: %v", int(position))
+	}
+	img, err := t.scale(img)
+	if err != nil {
+		return 0, 0, err
 	}
 	p := fmt.Sprintf("plStack%v", int(position)-1)
-	stack := m.Match(p, img)
-	stack = strings.Replace(stack, "L", "1.", -1)
-	window.DebugImage(VisualizeSource(img, []string{p}), "vision")
+	read := t.layout.m.Match(p, img)
+	t.debug(img, p)
+
+	return parseStack(read)
+}
+
+// parseStack returns the stack read in a stack region.
+func parseStack(read string) (poker.Amount, Confidence, error) {
+	stack := strings.Replace(read, "L", "1.", -1)
 
 	// All in is represented as -1.
 	if stack == "AllIn" {
-		return poker.Amount(-1), nil
+		return poker.Amount(-1), 1, nil
+	}
+
+	amount, err := poker.ParseAmount(stack)
+	return amount, amountConfidence(err, stack != read), err
+}
+
+// PlayerBet returns the amount a player has bet in the current betting round,
+// as shown in front of the seat. It is 0 if the player has not bet.
+func (t *Table) PlayerBet(img image.Image, position poker.PlayerPosition) (poker.Amount, Confidence, error) {
+
+	if position < 1 || int(position) > t.layout.seats {
+		return 0, 0, fmt.Errorf("Invalid player: %v", int(position))
+	}
+	img, err := t.scale(img)
+	if err != nil {
+		return 0, 0, err
+	}
+	p := fmt.Sprintf("plBet%v", int(position)-1)
+	read := t.layout.m.Match(p, img)
+	t.debug(img, p)
+
+	bet := strings.Replace(read, " ", "", -1)
+	bet = strings.Replace(bet, ",", "", -1)
+	bet = strings.TrimPrefix(bet, "$")
+	if bet == "" {
+		return 0, 1, nil
 	}
+	corrected := strings.Replace(bet, "L", "1.", -1)
 
-	return poker.ParseAmount(stack)
+	amount, err := poker.ParseAmount(corrected)
+	return amount, amountConfidence(err, corrected != bet), err
 }
 
 // PlayerName returns a player's name.
-func PlayerName(img image.Image, position poker.PlayerPosition) (string, error) {
+func (t *Table) PlayerName(img image.Image, position poker.PlayerPosition) (string, Confidence, error) {
 
-	if position < 1 {
-		return "", fmt.Errorf("Invalid player: %v", int(position))
+	if position < 1 || int(position) > t.layout.seats {
+		return "", 0, fmt.Errorf("Invalid player: %v", int(position))
+	}
+	img, err := t.scale(img)
+	if err != nil {
+		return "", 0, err
 	}
 
 	p := fmt.Sprintf("plName%v", int(position)-1)
-	name := m.Match(p, img)
-	window.DebugImage(VisualizeSource(img, []string{p}), "vision")
+	name := t.layout.m.Match(p, img)
+	t.debug(img, p)
 
-	return name, nil
+	return name, textConfidence(name), nil
 }
 
-// PlayerName returns a player's name.
-func PlayerAction(img image.Image, position poker.PlayerPosition) (string, error) {
+// PlayerAction returns a player's last action.
+func (t *Table) PlayerAction(img image.Image, position poker.PlayerPosition) (string, Confidence, error) {
 
-	if position < 1 {
-		return "", fmt.Errorf("Invalid player: %v", int(position))
+	if position < 1 || int(position) > t.layout.seats {
+		return "", 0, fmt.Errorf("Invalid player: %v", int(position))
+	}
+	img, err := t.scale(img)
+	if err != nil {
+		return "", 0, err
 	}
 
 	p := fmt.Sprintf("plAction%v", int(position)-1)
-	action := m.Match(p, img)
-	window.DebugImage(VisualizeSource(img, []string{p}), "vision")
+	action := t.layout.m.Match(p, img)
+	t.debug(img, p)
 
+	conf := t.matchConfidence(img, p, action)
 	if strings.HasPrefix(action, "actionFold") {
 		action = "actionFold"
 	}
 
-	return action, nil
+	return action, conf, nil
 }
 
 // ActivePlayers returns active players.
-func ActivePlayers(img image.Image) (ret []poker.PlayerPosition) {
+func (t *Table) ActivePlayers(img image.Image) ([]poker.PlayerPosition, error) {
+	img, err := t.scale(img)
+	if err != nil {
+		return nil, err
+	}
 
+	var ret []poker.PlayerPosition
 	var srcs []string
 
-	for i := 0; i < 6; i++ {
+	for i := 0; i < t.layout.seats; i++ {
 
 		p := fmt.Sprintf("plActive%v", i)
 		srcs = append(srcs, p)
 
-		active := m.Match(p, img)
+		active := t.layout.m.Match(p, img)
 		if len(active) != 0 {
 			ret = append(ret, poker.PlayerPosition(i+1))
 		}
 
 	}
 
-	window.DebugImage(VisualizeSource(img, srcs), "vision")
+	t.debug(img, srcs...)
 
-	return
+	return ret, nil
 }
 
-func ButtonPosition(img image.Image) poker.PlayerPosition {
-	for i := 0; i < 6; i++ {
-		btn := m.Match("button"+strconv.Itoa(i), img)
+func (t *Table) ButtonPosition(img image.Image) (poker.PlayerPosition, error) {
+	img, err := t.scale(img)
+	if err != nil {
+		return 0, err
+	}
+	for i := 0; i < t.layout.seats; i++ {
+		btn := t.layout.m.Match("button"+strconv.Itoa(i), img)
 		if len(btn) != 0 {
+			return poker.PlayerPosition(i + 1), nil
+		}
+	}
+	return 0, fmt.Errorf("unable to get button position")
+}
+
+// ShownCards returns the hole cards a player shows at showdown, or none if the
+// player does not show any.
+func (t *Table) ShownCards(img image.Image, position poker.PlayerPosition) ([]card.Card, Confidence, error) {
+
+	if position < 1 || int(position) > t.layout.seats {
+		return nil, 0, fmt.Errorf("Invalid player: %v", int(position))
+	}
+	img, err := t.scale(img)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	prefix := t.HoleCardsRegion(position)
+	var cards []card.Card
+	var srcs []string
+	conf := Confidence(1)
+	for i := 0; i < 2; i++ {
+		valSrc := fmt.Sprintf("%vValue%v", prefix, i)
+		colSrc := fmt.Sprintf("%vColor%v", prefix, i)
+		srcs = append(srcs, valSrc, colSrc)
+
+		val := t.layout.m.Match(valSrc, img)
+		col := t.layout.m.Match(colSrc, img)
+		if len(val) == 0 || len(col) == 0 {
+			break
+		}
+
+		c, err := card.ParseCard(fmt.Sprintf("%v%v", val[3:], col[:1]))
+		if err != nil {
+			return nil, 0, err
+		}
+		conf = minConfidence(conf, t.matchConfidence(img, valSrc, val),
+			t.matchConfidence(img, colSrc, col))
+		cards = append(cards, c)
+	}
+	t.debug(img, srcs...)
+
+	if len(cards) == 1 {
+		return nil, 0, fmt.Errorf("Only one shown card of player %v", int(position))
+	}
+	return cards, conf, nil
+}
+
+// HoleCardsRegion returns the prefix of the regions the cards of a seat are
+// read from, e.g. "shown2". The seat our own hole cards are usually dealt to
+// has the calibrated "pocket" regions, the regions of the other seats still
+// need tuning (see layouts).
+func (t *Table) HoleCardsRegion(position poker.PlayerPosition) string {
+	if position == t.layout.pocketSeat() {
+		return "pocket"
+	}
+	return fmt.Sprintf("shown%v", int(position)-1)
+}
+
+// pocketSeat returns the seat of the pocket regions, which lie where the cards
+// of the seat are shown, or 0 if the layout has none.
+func (l *layout) pocketSeat() poker.PlayerPosition {
+	if l.refs == nil {
+		return 0
+	}
+	pocket, ok := l.refs.regions["pocketValue0"]
+	if !ok {
+		return 0
+	}
+	for i := 0; i < l.seats; i++ {
+		shown, ok := l.refs.regions[fmt.Sprintf("shown%vValue0", i)]
+		if ok && shown.rect.Overlaps(pocket.rect) {
 			return poker.PlayerPosition(i + 1)
 		}
 	}
-	log.Printf("error: Unable to get button position")
 	return 0
 }
 
-func PocketCards(img image.Image) ([]card.Card, error) {
-	val0 := m.Match("pocketValue0", img)
-	col0 := m.Match("pocketColor0", img)
+// HoleCards returns the seat whose hole cards are face up and the cards, i.e.
+// our own seat while the hand is dealt. The seat of the pocket regions is read
+// first. The position is 0 if no seat shows its cards, and an error is
+// returned if more than one does.
+func (t *Table) HoleCards(img image.Image) (poker.PlayerPosition, []card.Card, Confidence, error) {
+	if pos := t.layout.pocketSeat(); pos != 0 {
+		cards, c, err := t.ShownCards(img, pos)
+		if err == nil && len(cards) == 2 && !c.Uncertain() {
+			return pos, cards, c, nil
+		}
+	}
+
+	seats := make([]seatCards, t.layout.seats)
+	for i := range seats {
+		s := &seats[i]
+		s.cards, s.conf, s.err = t.ShownCards(img, poker.PlayerPosition(i+1))
+	}
+	return holeCards(seats)
+}
 
-	val1 := m.Match("pocketValue1", img)
-	col1 := m.Match("pocketColor1", img)
+// seatCards are the cards read at a seat.
+type seatCards struct {
+	cards []card.Card
+	conf  Confidence
+	err   error
+}
 
-	if len(val0) == 0 || len(col0) == 0 {
-		val0 = "someInvalidCard"
-		col0 = "someInvalidCard"
+// holeCards returns the seat whose hole cards are face up given the cards read
+// at each seat. Cards which are uncertain only lower the confidence of finding
+// none.
+func holeCards(seats []seatCards) (poker.PlayerPosition, []card.Card, Confidence, error) {
+	var pos poker.PlayerPosition
+	var cards []card.Card
+	conf := Confidence(1)
+	for i, s := range seats {
+		if s.err != nil || len(s.cards) != 2 {
+			continue
+		}
+		if s.conf.Uncertain() {
+			// Unless other cards are found, these might have been ours.
+			if pos == 0 {
+				conf = minConfidence(conf, s.conf)
+			}
+			continue
+		}
+		if pos != 0 {
+			return 0, nil, 0, fmt.Errorf("Hole cards at seats %v and %v",
+				int(pos), i+1)
+		}
+		pos, cards, conf = poker.PlayerPosition(i+1), s.cards, s.conf
 	}
-	if len(val1) == 0 || len(col1) == 0 {
-		val1 = "someInvalidCard"
-		col1 = "someInvalidCard"
+	return pos, cards, conf, nil
+}
+
+func (t *Table) CommunityCards(img image.Image) ([]card.Card, Confidence, error) {
+	img, err := t.scale(img)
+	if err != nil {
+		return nil, 0, err
 	}
+	return t.board(img, "")
+}
 
-	c1, err1 := card.ParseCard(fmt.Sprintf("%v%v", val0[3:], col0[:1]))
-	c2, err2 := card.ParseCard(fmt.Sprintf("%v%v", val1[3:], col1[:1]))
+// CommunityBoards returns the community cards. A hand which is run twice has
+// two boards, which are shown above each other, any other hand has one.
+func (t *Table) CommunityBoards(img image.Image) ([][]card.Card, Confidence, error) {
+	img, err := t.scale(img)
+	if err != nil {
+		return nil, 0, err
+	}
 
-	if err1 != nil {
-		return []card.Card{c1, c2}, err1
+	top, topConf, err := t.board(img, "twiceTop")
+	if err != nil || len(top) == 0 {
+		cards, conf, err := t.board(img, "")
+		if err != nil {
+			return nil, 0, err
+		}
+		return [][]card.Card{cards}, conf, nil
 	}
 
-	return []card.Card{c1, c2}, err2
+	bot, botConf, err := t.board(img, "twiceBot")
+	if err != nil {
+		return nil, 0, err
+	}
+	return [][]card.Card{top, bot}, minConfidence(topConf, botConf), nil
 }
 
-func CommunityCards(img image.Image) ([]card.Card, error) {
+// board reads the board of the regions with the given suffix. The confidence
+// is that of the least certain card.
+func (t *Table) board(img image.Image, suffix string) ([]card.Card, Confidence, error) {
 
 	var cards []card.Card
+	conf := Confidence(1)
 
-	window.DebugImage(VisualizeSource(img, []string{
-		"commValue0", "commValue1", "commValue2", "commValue3", "commValue4",
-		"commColor0", "commColor1", "commColor2", "commColor3", "commColor4",
-	}), "vision")
+	var srcs []string
+	for i := 0; i < 5; i++ {
+		srcs = append(srcs, fmt.Sprintf("commValue%v%v", i, suffix),
+			fmt.Sprintf("commColor%v%v", i, suffix))
+	}
+	t.debug(img, srcs...)
 
 	for i := 0; i < 5; i++ {
 
-		val := m.Match(fmt.Sprintf("commValue%v", i), img)
-		col := m.Match(fmt.Sprintf("commColor%v", i), img)
+		valSrc := fmt.Sprintf("commValue%v%v", i, suffix)
+		colSrc := fmt.Sprintf("commColor%v%v", i, suffix)
+		val := t.layout.m.Match(valSrc, img)
+		col := t.layout.m.Match(colSrc, img)
 
 		if len(val) == 0 || len(col) == 0 {
 			break
@@ -208,8 +591,10 @@ func CommunityCards(img image.Image) ([]card.Card, error) {
 
 		c, err := card.ParseCard(fmt.Sprintf("%v%v", val[3:], col[:1]))
 		if err != nil {
-			return nil, err
+			return nil, 0, err
 		}
+		conf = minConfidence(conf, t.matchConfidence(img, valSrc, val),
+			t.matchConfidence(img, colSrc, col))
 
 		fmt.Println("CC:", c)
 		cards = append(cards, c)
@@ -217,19 +602,24 @@ func CommunityCards(img image.Image) ([]card.Card, error) {
 
 	num := len(cards)
 	if num != 0 && num != 3 && num != 4 && num != 5 {
-		return nil, fmt.Errorf("error: Unexpected amount of community cards %v", num)
+		return nil, 0, fmt.Errorf("error: Unexpected amount of community cards %v", num)
 	}
 
-	return cards, nil
+	return cards, conf, nil
 }
 
-func CurrentPlayer(img image.Image) poker.PlayerPosition {
-	for i := 0; i < 6; i++ {
-		active := m.Match("plCurrent"+strconv.Itoa(i), img)
+// CurrentPlayer returns the player to act, or 0 if no player is to act.
+func (t *Table) CurrentPlayer(img image.Image) (poker.PlayerPosition, error) {
+	img, err := t.scale(img)
+	if err != nil {
+		return 0, err
+	}
+	for i := 0; i < t.layout.seats; i++ {
+		active := t.layout.m.Match("plCurrent"+strconv.Itoa(i), img)
 		if active != "" {
-			return poker.PlayerPosition(i + 1)
+			return poker.PlayerPosition(i + 1), nil
 		}
 	}
 
-	return 0
+	return 0, nil
 }
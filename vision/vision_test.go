@@ -0,0 +1,162 @@
+package vision
+
+import (
+	"fmt"
+	"image"
+	"reflect"
+	"testing"
+
+	"github.com/whomever000/poker-common"
+	"github.com/whomever000/poker-common/card"
+)
+
+// fakeMatcher reads a name at the seats it holds.
+type fakeMatcher map[string]bool
+
+func (m fakeMatcher) Match(src string, img image.Image) string {
+	if m[src] {
+		return "alice"
+	}
+	return ""
+}
+
+func (m fakeMatcher) VisualizeSource(img image.Image, srcs []string) image.Image {
+	return img
+}
+
+// TestSeatsFromName verifies that table sizes are read from window names.
+func TestSeatsFromName(t *testing.T) {
+	tests := []struct {
+		name  string
+		seats int
+	}{
+		{"Aaltje II - $0.01/$0.02 USD - No Limit Hold'em 6-max", 6},
+		{"Halley 9-Max - Play Money No Limit Hold'em", 9},
+		{"Alcyone - Heads Up - Play Money No Limit Hold'em", 2},
+		{"Alcyone - Heads-up - Play Money No Limit Hold'em", 2},
+		{"Halley - $0.01/$0.02 USD - No Limit Hold'em", 0},
+		{"Halley 16-maximum - No Limit Hold'em", 0},
+		{"", 0},
+	}
+
+	for _, test := range tests {
+		if seats := SeatsFromName(test.name); seats != test.seats {
+			t.Errorf("%q: Expected %v seats, got %v", test.name, test.seats,
+				seats)
+		}
+	}
+}
+
+// TestDetectSeats verifies that the layout reading the most names is taken,
+// the larger one of layouts reading as many, and that tables without names
+// are not guessed.
+func TestDetectSeats(t *testing.T) {
+	defer func(l []*layout) { layouts = l }(layouts)
+
+	// names returns a matcher reading a name at the given seats.
+	names := func(seats ...int) fakeMatcher {
+		m := make(fakeMatcher)
+		for _, i := range seats {
+			m[fmt.Sprintf("plName%v", i)] = true
+		}
+		return m
+	}
+
+	size := image.Pt(80, 60)
+	tests := []struct {
+		name        string
+		small, big  fakeMatcher
+		seats       int
+		expectError bool
+	}{
+		{"more names", names(0, 1), names(3), 2, false},
+		{"tie", names(0, 1), names(1, 4), 6, false},
+		{"larger only", names(), names(1, 4), 6, false},
+		{"no names", names(), names(), 0, true},
+	}
+
+	for _, test := range tests {
+		layouts = []*layout{
+			{seats: 2, m: test.small, size: size},
+			{seats: 6, m: test.big, size: size},
+		}
+		img := image.NewRGBA(image.Rect(0, 0, size.X, size.Y))
+		seats, err := DetectSeats(img)
+		if (err != nil) != test.expectError || seats != test.seats {
+			t.Errorf("%v: Expected %v seats (error %v), got %v (%v)",
+				test.name, test.seats, test.expectError, seats, err)
+		}
+	}
+
+	// A table of another aspect ratio has no layout.
+	img := image.NewRGBA(image.Rect(0, 0, size.X*2, size.Y))
+	if seats, err := DetectSeats(img); err == nil {
+		t.Errorf("Expected an error for an image of another aspect ratio, "+
+			"got %v seats", seats)
+	}
+}
+
+// TestHoleCards verifies that the hole cards are those of the only seat whose
+// cards are read with certainty.
+func TestHoleCards(t *testing.T) {
+	ah, _ := card.ParseCard("Ah")
+	kd, _ := card.ParseCard("Kd")
+	cards := []card.Card{ah, kd}
+
+	certain := seatCards{cards: cards, conf: 1}
+	uncertain := seatCards{cards: cards, conf: 0.1}
+	failed := seatCards{err: fmt.Errorf("Only one shown card")}
+
+	tests := []struct {
+		name        string
+		seats       []seatCards
+		pos         poker.PlayerPosition
+		certain     bool
+		expectError bool
+	}{
+		{"none", []seatCards{{}, {}, {}}, 0, true, false},
+		{"ours", []seatCards{{}, {}, certain}, 3, true, false},
+		{"failed read", []seatCards{failed, certain, {}}, 2, true, false},
+		{"uncertain", []seatCards{{}, uncertain, {}}, 0, false, false},
+		{"uncertain and ours", []seatCards{uncertain, certain}, 2, true, false},
+		{"two seats", []seatCards{certain, {}, certain}, 0, false, true},
+	}
+
+	for _, test := range tests {
+		pos, got, c, err := holeCards(test.seats)
+		if (err != nil) != test.expectError {
+			t.Errorf("%v: Expected error %v, got %v", test.name,
+				test.expectError, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if pos != test.pos || c.Uncertain() == test.certain {
+			t.Errorf("%v: Expected seat %v (certain %v), got %v (confidence %v)",
+				test.name, test.pos, test.certain, pos, c)
+		}
+		if pos != 0 && !reflect.DeepEqual(got, cards) {
+			t.Errorf("%v: Expected cards %v, got %v", test.name, cards, got)
+		}
+	}
+}
+
+// TestHoleCardsRegion verifies that the cards of the seat of the pocket
+// regions are read from them.
+func TestHoleCardsRegion(t *testing.T) {
+	tb := &Table{layout: &layout{seats: 2, refs: &references{
+		regions: map[string]region{
+			"pocketValue0": {rect: image.Rect(10, 10, 20, 23)},
+			"shown0Value0": {rect: image.Rect(50, 10, 60, 23)},
+			"shown1Value0": {rect: image.Rect(10, 10, 20, 23)},
+		},
+	}}}
+
+	for pos, expected := range []string{"shown0", "pocket"} {
+		region := tb.HoleCardsRegion(poker.PlayerPosition(pos + 1))
+		if region != expected {
+			t.Errorf("Seat %v: Expected %v, got %v", pos+1, expected, region)
+		}
+	}
+}
@@ -0,0 +1,12 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import "errors"
+
+// windowNames returns the names of the visible top-level windows. Only
+// Windows is supported.
+func windowNames() ([]string, error) {
+	return nil, errors.New("listing windows is not supported on this system")
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+// This file lists the windows on Windows, where the tables are.
+
+var (
+	user32              = syscall.NewLazyDLL("user32.dll")
+	procEnumWindows     = user32.NewProc("EnumWindows")
+	procGetWindowTextW  = user32.NewProc("GetWindowTextW")
+	procIsWindowVisible = user32.NewProc("IsWindowVisible")
+)
+
+// The names found by enumWindowsProc. Callbacks cannot be freed, so there is
+// only the one, and windowNames is only called by one goroutine.
+var (
+	enumNames       []string
+	enumWindowsProc = syscall.NewCallback(func(hwnd syscall.Handle, _ uintptr) uintptr {
+		if visible, _, _ := procIsWindowVisible.Call(uintptr(hwnd)); visible == 0 {
+			return 1
+		}
+		buf := make([]uint16, 256)
+		n, _, _ := procGetWindowTextW.Call(uintptr(hwnd),
+			uintptr(unsafe.Pointer(&buf[0])), uintptr(len(buf)))
+		if n > 0 {
+			enumNames = append(enumNames, syscall.UTF16ToString(buf[:n]))
+		}
+		return 1
+	})
+)
+
+// windowNames returns the names of the visible top-level windows.
+func windowNames() ([]string, error) {
+	enumNames = nil
+	if ok, _, err := procEnumWindows.Call(enumWindowsProc, 0); ok == 0 {
+		return nil, err
+	}
+	return enumNames, nil
+}